@@ -6,258 +6,282 @@ black and whitelists along the way.  See README.rst for further details.
 package main
 
 import (
-	"bufio"
-	"cmp"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
-	"regexp"
-	"slices"
+	"os/signal"
+	"runtime"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/bronger/apply_my_lists/applymylists"
 	tbr_errors "gitlab.com/bronger/tools/errors"
 	tbr_logging "gitlab.com/bronger/tools/logging"
-	"go4.org/must"
-	"golang.org/x/exp/maps"
 )
 
-// init sets up logging.
+// init sets up logging.  It is reconfigured by setupLogging after the command
+// line was parsed.
 func init() {
 	tbr_logging.Init(os.Stderr, slog.LevelInfo)
 }
 
-const domFilepath = "/etc/hosts-blacklist"
-
-// readList reads the black or whitelist and returns its domain names.  See
-// README.rst for the file format.  As with the rest of this programm, all
-// domain names are prepended with a “.”, so that subdomain matching can be
-// realised with a simple HasSuffix.
-func readList(path string) (entries []string, err error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			slog.Warn("Could not find file; assumed empty", "path", path)
-			return nil, nil
+// reportProgress logs every “interval” how many of the “total” domains have
+// been checked by the workers so far, until “done” is closed.
+func reportProgress(numberChecked *atomic.Int64, total int, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			checked := numberChecked.Load()
+			percent := 100.0
+			if total > 0 {
+				percent = 100 * float64(checked) / float64(total)
+			}
+			slog.Info("Minimisation progress", "checked", checked, "total", total,
+				"percent", fmt.Sprintf("%.1f", percent))
+		case <-done:
+			return
 		}
-		return nil, fmt.Errorf("Could not open list file “%v”", path)
 	}
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+}
+
+// setupLogging replaces the logging set up in init according to the command
+// line options.  “format” is either “text” or “json”.  If “path” is not
+// empty, log messages are appended to the file at “path” instead of being
+// written to stderr.
+func setupLogging(format, path string, level slog.Level) error {
+	var w io.Writer = os.Stderr
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("Could not open log file “%v”: %w", path, err)
 		}
-		entries = append(entries, "."+line)
+		w = f
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("Error while reading list file “%v”: %w", path, err)
+	switch format {
+	case "text":
+		tbr_logging.Init(w, level)
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})))
+	default:
+		return fmt.Errorf("Invalid log format “%v”", format)
 	}
-	return
+	return nil
 }
 
-// getTLD extracts the top level domain from the given domain.  It panics if
-// there is none to extract.
-func getTLD(domain string) string {
-	components := strings.Split(domain, ".")
-	length := len(components)
-	return components[length-2] + "." + components[length-1]
+// Exit codes of the program, see README.rst.
+const (
+	// exitInput is used for errors in the input file, the personal lists, or
+	// other files read.
+	exitInput = 2
+	// exitOutput is used for errors writing the output file, the diff, or the
+	// statistics.
+	exitOutput = 3
+	// exitUsage is used for invalid command line options.
+	exitUsage = 4
+	// exitTimeout is used if the timeout was exceeded.
+	exitTimeout = 5
+	// exitInterrupted is used if the program was stopped by SIGINT or
+	// SIGTERM.
+	exitInterrupted = 130
+)
+
+// inputFormats maps the valid values of the “-input-format” option to their
+// implementations.
+var inputFormats = map[string]applymylists.InputFormat{
+	"hosts": applymylists.FormatHosts,
+	"abp":   applymylists.FormatABP,
+	"plain": applymylists.FormatPlain,
+	"auto":  applymylists.FormatAuto,
 }
 
-var hostRegexp = regexp.MustCompile(`0\.0\.0\.0 (.*)`)
+// flagAliases maps the alternative names of flags to their canonical names.
+// The aliases are defined by main, sharing the value of the canonical flag.
+var flagAliases = map[string]string{
+	"include-tld": "only-tld",
+	"v":           "verbose",
+	"q":           "quiet",
+}
 
-// readDomains reads the large blacklist file and returns a mapping from top
-// level domains to a set of domains that belong to this TLD.  (This may
-// include the TLD itself.)  A “set” is a mapping to bool which is never false.
-// All domain names are prepended with a “.”, so that subdomain matching can be
-// realised with a simple HasSuffix.
-func readDomains() (domainsRaw map[string]map[string]bool, err error) {
-	domainsRaw = make(map[string]map[string]bool)
-	slog.Info("Reading domains")
-	f, err := os.Open(domFilepath)
-	if err != nil {
-		return nil, fmt.Errorf("Could not open domains file “%v”", domFilepath)
+// canonicalFlagName returns the canonical name of the flag “name”, which may be
+// an alias, see flagAliases.
+func canonicalFlagName(name string) string {
+	if canonical, ok := flagAliases[name]; ok {
+		return canonical
 	}
-	defer must.Close(f)
-	scanner := bufio.NewScanner(f)
-	scanner.Split(bufio.ScanLines)
-	var numberDomains int
-	for scanner.Scan() {
-		line := scanner.Text()
-		domain := "." + hostRegexp.FindStringSubmatch(line)[1]
-		if domain == "." {
-			return nil, fmt.Errorf("Invalid line in domains file: “%s”", line)
-		}
-		numberDomains++
-		tld := getTLD(domain)
-		if _, exists := domainsRaw[tld]; !exists {
-			domainsRaw[tld] = make(map[string]bool)
-		}
-		domainsRaw[tld][domain] = true
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("Error while reading domains file “%v”: %w", domFilepath, err)
-	}
-	slog.Info("Finished reading domains", "number", numberDomains, "numberTLDs", len(domainsRaw))
-	return
+	return name
 }
 
-// cookDomains simplfies the nested maps into nested slices.  This makes some
-// operations faster.   It is called after the maps have served their purpose
-// to ensure fast lookups and ensure uniqueness.  The domain slices are sorted by
-// length in order to have a reliable breaking condition when looking for
-// subdomains.  (A domain can never be longer than its subdomain.)
-func cookDomains(domainsRaw map[string]map[string]bool) (domains [][]string) {
-	for _, subdomains := range domainsRaw {
-		cookedSDs := maps.Keys(subdomains)
-		slices.SortFunc(cookedSDs, func(a, b string) int {
-			return cmp.Compare(len(a), len(b))
-		})
-		domains = append(domains, cookedSDs)
-	}
-	return
+// stringList is a flag.Value for options that may be given multiple times.
+// The initial values are the default which is replaced by the first explicitly
+// given value.
+type stringList struct {
+	values []string
+	isSet  bool
 }
 
-// checkDomain sends domains which are not subdomains of any other blacklisted
-// domain to the “minimal” channel.  This channel is the result of the program.
-// The loop here is the hot loop of the program which has to be as performant
-// as possible.  For instance, we make use of the fact that the items in the
-// subdomains slice become longer and longer.
-func checkDomain(subdomains []string, domain string, minimal chan<- string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	lenDomain := len(domain)
-	for _, otherDomain := range subdomains {
-		if len(otherDomain) > lenDomain {
-			break
-		}
-		if strings.HasSuffix(domain, otherDomain) && domain != otherDomain {
-			return
-		}
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
 	}
-	minimal <- domain
+	return strings.Join(l.values, ", ")
 }
 
-// applyBlacklist adds the entries in the personal blacklist to the set of
-// domains.
-func applyBlacklist(path string, domainsRaw map[string]map[string]bool) error {
-	blackDomains, err := readList(path)
-	if err != nil {
-		return fmt.Errorf("Error while reading blacklist: %w", err)
-	}
-	tbr_errors.ExitOnExpectedError(err, "Error while reading blacklist", 2)
-	for _, domain := range blackDomains {
-		tld := getTLD(domain)
-		if _, exists := domainsRaw[tld]; !exists {
-			domainsRaw[tld] = make(map[string]bool)
-		}
-		domainsRaw[tld][domain] = true
+func (l *stringList) Set(value string) error {
+	if !l.isSet {
+		l.values = nil
+		l.isSet = true
 	}
+	l.values = append(l.values, value)
 	return nil
 }
 
-var tldLocks = make(map[string]*sync.RWMutex)
-var tldLocksLock sync.RWMutex
-
-// whitelist holds all domains that need to be whitelisted explicitly because
-// they are subdomains of blacklisted domains.
-var whitelist = make(map[string]bool)
-var whitelistLock sync.RWMutex
-
-// applyWhitelistEntry does the parallisable work for applyWhitelist.  It
-// removed the domain gives as “entry” and all of its subdomains from the
-// blacklist.  Moreover, it adds domains to “whitelist” if they are subdomains
-// of blacklisted domains.
-func applyWhitelistEntry(entry string, domainsRaw map[string]map[string]bool, wg *sync.WaitGroup) {
-	defer wg.Done()
-	tld := getTLD(entry)
-	tldLocksLock.Lock()
-	lock, exists := tldLocks[tld]
-	if !exists {
-		lock = new(sync.RWMutex)
-		tldLocks[tld] = lock
+func main() {
+	cfg := config{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}
+	inputPaths := stringList{values: []string{"/etc/hosts-blacklist"}}
+	flag.Var(&inputPaths, "input",
+		"`path` or URL of the large blacklist in the format given by -input-format; may be given multiple times")
+	blacklistPaths := stringList{values: []string{"/tmp/my_blacklist"}}
+	flag.Var(&blacklistPaths, "blacklist", "`path`, directory, or glob of personal blacklists; may be given multiple times")
+	whitelistPaths := stringList{values: []string{"/tmp/my_whitelist"}}
+	flag.Var(&whitelistPaths, "whitelist", "`path`, directory, or glob of personal whitelists; may be given multiple times")
+	var whitelistExactPaths stringList
+	flag.Var(&whitelistExactPaths, "whitelist-exact",
+		"`path`, directory, or glob of personal whitelists not affecting subdomains; may be given multiple times")
+	flag.StringVar(&cfg.keepPath, "regex-keep", "",
+		"`path` to regular expressions for domains which are kept blacklisted despite the whitelist")
+	flag.StringVar(&cfg.outputPath, "output", "/etc/servers-blacklist", "path to the output file")
+	flag.IntVar(&cfg.workers, "workers", runtime.NumCPU(),
+		"number of concurrent workers for reading, applying the lists, and minimising")
+	flag.BoolVar(&cfg.appendOutput, "append", false,
+		"merge the entries of the existing output file into the new one instead of replacing them")
+	flag.StringVar(&cfg.diffPath, "diff", "",
+		"`path` for the changes of the blacklisted domains compared to the existing output file; “-” for stdout")
+	flag.IntVar(&cfg.writeOptions.retry.attempts, "write-attempts", 3,
+		"number of attempts for creating and renaming the output file on transient errors")
+	flag.DurationVar(&cfg.writeOptions.retry.delay, "write-retry-delay", time.Second,
+		"waiting time before retrying to write the output file; doubled with every retry")
+	flag.BoolVar(&cfg.writeOptions.checksum, "checksum", false,
+		"write the SHA-256 of the output file to a file with “.sha256” appended to its path")
+	flag.BoolVar(&cfg.splitByTLD, "split-by-tld", false,
+		"write one output file per top level domain, with the TLD appended to the output path")
+	flag.BoolVar(&cfg.validateOutput, "validate-output", false,
+		"check every line of the output file before it replaces the old one")
+	flag.StringVar(&cfg.whitelistPath, "whitelist-output", "",
+		"`path` for an additional file with the explicitly whitelisted domains")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "print statistics to stderr instead of writing the output file")
+	flag.BoolVar(&cfg.countOnly, "count-only", false,
+		"only read the input file and print the numbers of its domains and TLDs to stdout")
+	flag.BoolVar(&cfg.normalizeOnly, "normalize-only", false,
+		"write the domains of the input file as a sorted hosts file, without applying the lists or minimising")
+	flag.BoolVar(&cfg.listTLDs, "list-tlds", false,
+		"print the number of domains per TLD to stdout instead of writing the output file")
+	flag.BoolVar(&cfg.lintWhitelist, "lint-whitelist", false,
+		"print the whitelist entries without effect to stdout instead of writing the output file")
+	flag.StringVar(&cfg.outputFormat, "output-format", "dnsmasq",
+		"format of the output file; one of "+strings.Join(outputFormatNames(), ", "))
+	flag.StringVar(&cfg.sortOutput, "sort-output", "lexical",
+		"order of the blacklisted domains within each TLD; “none”, “lexical”, or “length”")
+	flag.StringVar(&cfg.sinkAddress, "sink-address", "0.0.0.0",
+		"IP address for blacklisted domains in the hosts output format")
+	flag.StringVar(&cfg.whitelistForward, "whitelist-forward", "#",
+		"IP address of the upstream server for whitelisted domains in the dnsmasq output format; “#” for the standard servers")
+	flag.StringVar(&cfg.template, "template", "",
+		"Go template for the lines of blacklisted domains, e.g. “address=/{{.Domain}}/0.0.0.0”; empty for the output format's lines")
+	flag.StringVar(&cfg.whitelistTemplate, "whitelist-template", "",
+		"Go template for the lines of whitelisted domains; empty for the output format's lines")
+	flag.StringVar(&cfg.statsJSONPath, "stats-json", "", "path to a file to write statistics as JSON to; “-” for stdout")
+	var excludedTLDs stringList
+	flag.Var(&excludedTLDs, "exclude-tld",
+		"`domain`, e.g. “gov”, below which nothing is blacklisted; may be given multiple times")
+	var onlyTLDs stringList
+	flag.Var(&onlyTLDs, "only-tld",
+		"`domain`, e.g. “com”, to which the blacklisting is restricted; may be given multiple times")
+	flag.StringVar(&cfg.inputFormat, "input-format", "hosts", "format of the input file; “hosts”, “abp”, “plain”, or “auto”")
+	flag.BoolVar(&cfg.annotate, "annotate", false, "add a comment with the source lists to every blacklisted domain")
+	flag.IntVar(&cfg.maxDomains, "max-domains", 0, "maximal number of domains in the input file; 0 for no limit")
+	flag.IntVar(&cfg.maxDomainLength, "max-domain-length", 0,
+		"maximal length of domains kept from the input file; 0 for no limit")
+	flag.IntVar(&cfg.maxSubdomainDepth, "max-subdomain-depth", 0,
+		"maximal number of labels in front of the registrable domain of domains kept from the input file; 0 for no limit")
+	flag.StringVar(&cfg.hostRegexp, "host-regexp", "",
+		"`regexp` for the lines of the input file in hosts format; its only group must capture the domain")
+	flag.StringVar(&cfg.since, "since", "",
+		"`date` in the form YYYY-MM-DD; drop domains of the input file added before it according to their comment")
+	flag.BoolVar(&cfg.mmap, "mmap", false, "map the input file into memory instead of reading it; faster for large files")
+	flag.BoolVar(&cfg.strict, "strict", false, "abort on invalid domain names instead of skipping them")
+	flag.DurationVar(&cfg.httpTimeout, "http-timeout", 5*time.Minute, "timeout for downloading lists given as URLs")
+	flag.StringVar(&cfg.cacheDir, "cache-dir", "", "directory for caching lists given as URLs; empty for no caching")
+	flag.StringVar(&cfg.inputCacheDir, "input-cache-dir", "",
+		"directory for caching the input file in minimised form; empty for no caching")
+	flag.DurationVar(&cfg.timeout, "timeout", 0, "maximal duration of the whole run; 0 for no limit")
+	var verbose, quiet bool
+	flag.BoolVar(&verbose, "verbose", false, "log debug messages; takes precedence over -quiet")
+	flag.BoolVar(&quiet, "quiet", false, "log only warnings and errors")
+	flag.DurationVar(&cfg.progressInterval, "progress-interval", 10*time.Second,
+		"interval for logging the progress of finding the minimal domains; 0 for no progress logging")
+	logFormat := flag.String("log-format", "text", "format of log messages; “text” or “json”")
+	logPath := flag.String("log-file", "", "path to a file log messages are appended to; empty for stderr")
+	cpuProfilePath := flag.String("cpuprofile", "", "`path` to write a CPU profile to; empty for none")
+	memProfilePath := flag.String("memprofile", "", "`path` to write a memory profile to at the end; empty for none")
+	reportResources := flag.Bool("report-resources", false,
+		"log the peak number of goroutines and the peak heap size at the end")
+	configPath := flag.String("config", "",
+		"`path` to a TOML configuration file setting the options; the command line takes precedence")
+	for alias, name := range flagAliases {
+		flag.Var(flag.Lookup(name).Value, alias, "alias for -"+name)
 	}
-	tldLocksLock.Unlock()
-	lock.RLock()
-	subdomains := domainsRaw[tld]
-	lock.RUnlock()
-	var needsOnWhitelist bool
-	for subdomain := range subdomains {
-		if strings.HasSuffix(subdomain, entry) {
-			lock.Lock()
-			delete(domainsRaw[tld], subdomain)
-			lock.Unlock()
-			slog.Debug("Remove domain because of whitelisting", "entry", entry, "domain", subdomain)
-		} else if !needsOnWhitelist && strings.HasSuffix(entry, subdomain) {
-			needsOnWhitelist = true
-			slog.Debug("Add domain to explicit whitelisting", "entry", entry, "shadower", subdomain)
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
 		}
+		os.Exit(exitUsage)
 	}
-	if needsOnWhitelist {
-		whitelistLock.Lock()
-		whitelist[entry] = true
-		whitelistLock.Unlock()
+	if *configPath != "" {
+		err := loadConfigFile(*configPath, flag.CommandLine)
+		tbr_errors.ExitOnExpectedError(err, "Could not read configuration file", exitUsage)
 	}
-}
-
-// applyWhitelist removes domains of the personal whitelist (and their
-// subdomains) from the set of domains.  Moreover, it adds whitelisted domains
-// that are subdomains to other blacklisted domains to the “whitelist” map so
-// that they can be whitelisted explicitly in the output.
-func applyWhitelist(path string, domainsRaw map[string]map[string]bool) error {
-	whiteDomains, err := readList(path)
-	if err != nil {
-		return fmt.Errorf("Error while reading whitelist: %w", err)
+	cfg.inputPaths = inputPaths.values
+	cfg.blacklistPaths = blacklistPaths.values
+	cfg.whitelistPaths = whitelistPaths.values
+	cfg.whitelistExactPaths = whitelistExactPaths.values
+	cfg.excludedTLDs = excludedTLDs.values
+	cfg.onlyTLDs = onlyTLDs.values
+	logLevel := slog.LevelInfo
+	switch {
+	case verbose:
+		logLevel = slog.LevelDebug
+	case quiet:
+		logLevel = slog.LevelWarn
 	}
-	tbr_errors.ExitOnExpectedError(err, "Error while reading whitelist", 2)
-	var wg sync.WaitGroup
-	for _, domain := range whiteDomains {
-		wg.Add(1)
-		go applyWhitelistEntry(domain, domainsRaw, &wg)
+	err := setupLogging(*logFormat, *logPath, logLevel)
+	tbr_errors.ExitOnExpectedError(err, "Could not set up logging", exitUsage)
+	stopProfiling, err := startProfiling(*cpuProfilePath, *memProfilePath)
+	tbr_errors.ExitOnExpectedError(err, "Could not start profiling", exitUsage)
+	stopResourceReport := func() {}
+	if *reportResources {
+		stopResourceReport = startResourceReport()
 	}
-	wg.Wait()
-	return nil
-}
-
-func main() {
-	domainsRaw, err := readDomains()
-	tbr_errors.ExitOnExpectedError(err, "Could not read domains", 2)
-	applyBlacklist("/tmp/my_blacklist", domainsRaw)
-	applyWhitelist("/tmp/my_whitelist", domainsRaw)
-	domains := cookDomains(domainsRaw)
-	minimal := make(chan string)
-	var wgCollect sync.WaitGroup
-	var numberMinimal int
-	wgCollect.Add(1)
-	go func() {
-		defer wgCollect.Done()
-		f, err := os.Create("/etc/servers-blacklist")
-		tbr_errors.ExitOnExpectedError(err, "Error creating file “servers-blacklist”", 2)
-		defer must.Close(f)
-		w := bufio.NewWriter(f)
-		defer must.Do(w.Flush)
-		for domain := range minimal {
-			numberMinimal++
-			_, err := w.WriteString(fmt.Sprintf("server=/%s/\n", domain[1:]))
-			tbr_errors.ExitOnExpectedError(err, "Error writing to file “servers-blacklist”", 2)
-		}
-		for domain := range whitelist {
-			_, err := w.WriteString(fmt.Sprintf("server=/%s/#\n", domain[1:]))
-			tbr_errors.ExitOnExpectedError(err, "Error writing to file “servers-blacklist”", 2)
-		}
-	}()
-	var wg sync.WaitGroup
-	for _, subdomains := range domains {
-		for _, domain := range subdomains {
-			wg.Add(1)
-			go checkDomain(subdomains, domain, minimal, &wg)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx, cfg)
+	stop()
+	stopResourceReport()
+	if err := stopProfiling(); err != nil {
+		slog.Warn("Could not write profiles", "error", err)
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		if exitErr.err == nil {
+			tbr_errors.ExitWithExpectedError(exitErr.message, exitErr.code, exitErr.args...)
 		}
+		tbr_errors.ExitOnExpectedError(exitErr.err, exitErr.message, exitErr.code, exitErr.args...)
 	}
-	slog.Info("Created all workers")
-	wg.Wait()
-	close(minimal)
-	wgCollect.Wait()
-	slog.Info("Minimal domains collected", "number", numberMinimal)
-	slog.Info("Finished")
 }
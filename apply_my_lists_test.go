@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetupLoggingJSON(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	path := filepath.Join(t.TempDir(), "log")
+	if err := setupLogging("json", path, slog.LevelInfo); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("Test message", "number", 42)
+	slog.Debug("Suppressed message")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(content), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1: %q", len(lines), content)
+	}
+	var record map[string]any
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[0], err)
+	}
+	if record["msg"] != "Test message" || record["number"] != 42.0 {
+		t.Errorf("got record %v", record)
+	}
+	if err := setupLogging("xml", "", slog.LevelInfo); err == nil {
+		t.Error("invalid log format did not fail")
+	}
+}
@@ -0,0 +1,90 @@
+package applymylists_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+)
+
+var logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestPipeline runs the whole processing through the exported API only, like
+// an embedding program would.
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	input := "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n0.0.0.0 tracker.example.org\n" +
+		"0.0.0.0 cdn.example.net\n"
+	domains, exceptions, err := applymylists.ReadDomains(ctx, strings.NewReader(input), applymylists.ReadOptions{},
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exceptions) != 0 {
+		t.Errorf("got exceptions %q from a hosts file", exceptions)
+	}
+	blacklist, err := applymylists.ReadList(strings.NewReader("evil.example.com\n"), applymylists.ReadOptions{},
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applymylists.ApplyBlacklist(domains, blacklist, "blacklist", 0, logger)
+	whitelist, err := applymylists.ReadList(strings.NewReader("tracker.example.org\nok.ads.example.com\n"),
+		applymylists.ReadOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit, unused, err := applymylists.ApplyWhitelist(ctx, domains, whitelist, 0, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ok.ads.example.com"}; !slices.Equal(explicit, want) {
+		t.Errorf("got explicit entries %q, want %q", explicit, want)
+	}
+	if len(unused) != 0 {
+		t.Errorf("got unused entries %q", unused)
+	}
+	minimal, err := applymylists.Minimize(ctx, domains, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ads.example.com", "evil.example.com", "cdn.example.net"}; !slices.Equal(minimal, want) {
+		t.Errorf("got %q, want %q", minimal, want)
+	}
+	if domains.Len() != 0 {
+		t.Errorf("Minimize left %d domains", domains.Len())
+	}
+}
+
+// TestMinimizeDefaultWorkers checks that Minimize falls back to the number of
+// CPUs for “workers” less than 1 also for groups large enough for the worker
+// pool.
+func TestMinimizeDefaultWorkers(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&input, "0.0.0.0 s%d.example.com\n", i)
+	}
+	input.WriteString("0.0.0.0 example.com\n")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, workers := range []int{0, -1} {
+		domains, _, err := applymylists.ReadDomains(ctx, strings.NewReader(input.String()),
+			applymylists.ReadOptions{}, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		minimal, err := applymylists.Minimize(ctx, domains, workers, nil)
+		if err != nil {
+			t.Fatalf("workers %d: %v", workers, err)
+		}
+		if want := []string{"example.com"}; !slices.Equal(minimal, want) {
+			t.Errorf("workers %d: got %q, want %q", workers, minimal, want)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package applymylists
+
+import (
+	"context"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	tbr_logging "gitlab.com/bronger/tools/logging"
+	"golang.org/x/exp/maps"
+)
+
+// blacklistResult collects the outcome of applyBlacklistEntries.
+type blacklistResult struct {
+	numberAdded, numberPresent, numberBelowParent int
+	// changes contains the added domains, and the removed ones prefixed with
+	// “-”, in the order of the entries, so that the sources can be updated
+	// afterwards.  All domains have the leading “.”.
+	changes []string
+}
+
+// applyBlacklistEntries does the parallelisable work for ApplyBlacklist.  It
+// applies the given “entries”, which all belong to the TLD “tld” and have the
+// leading “.”, to “subdomains”, the set of blacklisted domains of that TLD.
+// Removal entries are prefixed with “-”.  Domains which were not in
+// “subdomains” before are recorded in “added”, the set of domains of that TLD
+// added by ApplyBlacklist.  The caller must make sure that no other goroutine
+// accesses “subdomains”, “added”, or “result” while this function is running.
+func applyBlacklistEntries(domains *Domains, tld string, entries []string, subdomains, added map[string]struct{},
+	result *blacklistResult, logger tbr_logging.Logger) {
+	for _, entry := range entries {
+		if domain, removal := strings.CutPrefix(entry, "-"); removal {
+			if _, ok := subdomains[domain]; !ok {
+				logger.Debug("Removal entry in blacklist matched nothing", "entry", "-"+domain[1:])
+				continue
+			}
+			delete(subdomains, domain)
+			delete(added, domain)
+			result.changes = append(result.changes, entry)
+			continue
+		}
+		result.numberAdded++
+		switch parent := domains.upstreamCoveringDomain(tld, entry); parent {
+		case "":
+		case entry:
+			logger.Debug("Blacklist entry is already present", "entry", entry[1:])
+			result.numberPresent++
+		default:
+			logger.Debug("Blacklist entry is redundant", "entry", entry[1:], "coveredBy", parent[1:])
+			result.numberBelowParent++
+		}
+		if _, ok := subdomains[entry]; !ok {
+			subdomains[entry] = struct{}{}
+			added[entry] = struct{}{}
+		}
+		result.changes = append(result.changes, entry)
+	}
+}
+
+// ApplyBlacklist adds the entries of a personal blacklist, as returned by
+// ReadList, to “domains”.  Entries below the excluded TLDs of “domains” are
+// skipped, see ReadOptions.  So are entries whose TLD cannot be determined,
+// e.g. “localhost”, and wildcard entries, but with a warning.  Entries which
+// are already in the large blacklist, or whose parent domain is, are redundant;
+// they are logged on debug level, and their numbers, separately for both cases,
+// on info level.  Domains added by earlier entries or earlier calls do not
+// count for this.  An entry prefixed with “-” removes exactly this domain from “domains”
+// instead, if it is there, but neither its subdomains nor any parent domain.
+// The entries are applied in order, so that a later entry can undo an earlier
+// one.  If sources are tracked, “source” is recorded as the name of the list
+// for every entry.
+//
+// Like in ApplyWhitelist, the entries are grouped by TLD, and the groups are
+// processed by “workers” goroutines, or as many as there are CPUs if “workers”
+// is less than 1.  Missing sets of subdomains are created beforehand, so that
+// the goroutines only read the map of TLDs.  The order of the entries is
+// preserved within each group, which suffices because an entry can only undo
+// an entry of the same TLD.  The sources are updated after all goroutines have
+// finished.  “domains” must not be accessed by anything else while this
+// function is running.
+func ApplyBlacklist(domains *Domains, entries []string, source string, workers int, logger tbr_logging.Logger) {
+	entriesByTLD := make(map[string][]string)
+	for _, entry := range entries {
+		domain, removal := strings.CutPrefix(entry, "-")
+		domain = "." + domain
+		if removal {
+			if tld, err := getTLD(domain); err != nil {
+				logger.Debug("Removal entry in blacklist matched nothing", "entry", entry)
+			} else {
+				entriesByTLD[tld] = append(entriesByTLD[tld], "-"+domain)
+			}
+			continue
+		}
+		if strings.HasPrefix(domain, ".*.") {
+			logger.Warn("Ignoring wildcard entry; only supported in whitelists", "entry", entry)
+			continue
+		}
+		if domains.isExcluded(domain) {
+			continue
+		}
+		tld, err := getTLD(domain)
+		if err != nil {
+			logger.Warn("Ignoring blacklist entry", "entry", entry, "error", err)
+			continue
+		}
+		if _, exists := domains.byTLD[tld]; !exists {
+			domains.byTLD[tld] = make(map[string]struct{})
+		}
+		if _, exists := domains.added[tld]; !exists {
+			domains.added[tld] = make(map[string]struct{})
+		}
+		entriesByTLD[tld] = append(entriesByTLD[tld], domain)
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	tlds := maps.Keys(entriesByTLD)
+	results := make([]blacklistResult, len(tlds))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				tld := tlds[j]
+				applyBlacklistEntries(domains, tld, entriesByTLD[tld], domains.byTLD[tld], domains.added[tld],
+					&results[j], logger)
+			}
+		}()
+	}
+	for j := range tlds {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	var numberAdded, numberPresent, numberBelowParent int
+	for _, result := range results {
+		numberAdded += result.numberAdded
+		numberPresent += result.numberPresent
+		numberBelowParent += result.numberBelowParent
+		for _, change := range result.changes {
+			if domain, removal := strings.CutPrefix(change, "-"); removal {
+				delete(domains.sources, domain)
+			} else {
+				domains.addSource(domain, source)
+			}
+		}
+	}
+	if numberPresent+numberBelowParent > 0 {
+		logger.Info("Some blacklist entries are already covered", "number", numberPresent+numberBelowParent,
+			"total", numberAdded, "present", numberPresent, "belowParent", numberBelowParent)
+	}
+}
+
+// Conflicts returns the entries which are both on a personal blacklist and on
+// a personal whitelist, sorted and without duplicates.  Since the whitelist is
+// applied after the blacklist, such blacklist entries have no effect.
+func Conflicts(blacklist, whitelist []string) (conflicts []string) {
+	whitelisted := make(map[string]struct{}, len(whitelist))
+	for _, entry := range whitelist {
+		whitelisted[entry] = struct{}{}
+	}
+	for _, entry := range blacklist {
+		if _, ok := whitelisted[entry]; ok {
+			conflicts = append(conflicts, entry)
+			delete(whitelisted, entry)
+		}
+	}
+	slices.Sort(conflicts)
+	return
+}
+
+// whitelistResult collects the outcome of applyWhitelistEntries.  Both slices
+// contain domains with the leading “.”.
+type whitelistResult struct {
+	explicit, unused []string
+}
+
+// applyWhitelistEntries does the parallelisable work for ApplyWhitelist.  It
+// removes the domains given as “entries”, which all belong to the same TLD, and
+// all of their subdomains from “subdomains”, the set of blacklisted domains of
+// that TLD, except for those matching the keep patterns of “domains”.  Entries
+// that are subdomains of blacklisted domains are added to “result.explicit”,
+// entries that had no effect at all to “result.unused”.  Wildcard entries,
+// which start with “.*.”, spare their domain itself, see ApplyWhitelist.  The
+// caller must make sure that no other goroutine accesses “subdomains” or
+// “result” while this function is running.  It stops early if “ctx” is
+// cancelled.
+func applyWhitelistEntries(ctx context.Context, domains *Domains, entries []string, subdomains map[string]struct{},
+	result *whitelistResult, logger tbr_logging.Logger) {
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		domain, wildcard := strings.CutPrefix(entry, ".*")
+		var needsOnWhitelist bool
+		var numberRemoved int
+		for subdomain := range subdomains {
+			if isSubdomain(subdomain, domain) && !(wildcard && subdomain == domain) {
+				if domains.isKept(subdomain) {
+					logger.Debug("Keep domain despite whitelisting", "entry", entry, "domain", subdomain)
+					continue
+				}
+				delete(subdomains, subdomain)
+				numberRemoved++
+				logger.Debug("Remove domain because of whitelisting", "entry", entry, "domain", subdomain)
+			} else if !needsOnWhitelist && isSubdomain(domain, subdomain) {
+				needsOnWhitelist = true
+				logger.Debug("Add domain to explicit whitelisting", "entry", entry, "shadower", subdomain)
+			}
+		}
+		if needsOnWhitelist && wildcard {
+			logger.Warn("Wildcard whitelist entry is covered by a blacklisted domain; its subdomains stay "+
+				"blocked in output formats matching subdomains", "entry", entry[1:])
+		} else if needsOnWhitelist {
+			result.explicit = append(result.explicit, entry)
+		} else if numberRemoved == 0 {
+			result.unused = append(result.unused, entry)
+		}
+	}
+}
+
+// ApplyWhitelist removes the entries of a personal whitelist, as returned by
+// ReadList, and their subdomains from “domains”.  It returns the entries that
+// are subdomains of other blacklisted domains in “explicit”, so that they can
+// be whitelisted explicitly in the output, and the entries which had no effect
+// at all in “unused”.  Both are returned in no particular order.  Entries
+// whose TLD cannot be determined are skipped with a warning.  Domains matching
+// a pattern set with SetKeepPatterns are never removed.
+//
+// A wildcard entry like “*.cdn.example” removes only the subdomains of
+// “cdn.example”, but not “cdn.example” itself.  It cannot be whitelisted
+// explicitly, because the output formats have no way to express this.
+//
+// The whitelist entries are grouped by TLD, and the groups are processed by
+// “workers” goroutines, or as many as there are CPUs if “workers” is less than
+// 1.  Every group is processed by exactly one goroutine, so that each set of
+// subdomains in “domains” is owned by it, and no locking is necessary for it.
+// Still, “domains” must not be accessed by anything else while this function
+// is running.  If “ctx” is cancelled, its error is returned and “domains” is
+// left partially modified.
+func ApplyWhitelist(ctx context.Context, domains *Domains, entries []string, workers int,
+	logger tbr_logging.Logger) (explicit, unused []string, err error) {
+	entriesByTLD := make(map[string][]string)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "-") {
+			logger.Warn("Ignoring removal entry; only supported in blacklists", "entry", entry)
+			continue
+		}
+		entry = "." + entry
+		tld, err := getTLD(strings.TrimPrefix(entry, ".*"))
+		if err != nil {
+			logger.Warn("Ignoring whitelist entry", "entry", entry[1:], "error", err)
+			continue
+		}
+		entriesByTLD[tld] = append(entriesByTLD[tld], entry)
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	tlds := maps.Keys(entriesByTLD)
+	results := make([]whitelistResult, len(tlds))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				tld := tlds[j]
+				applyWhitelistEntries(ctx, domains, entriesByTLD[tld], domains.byTLD[tld], &results[j], logger)
+			}
+		}()
+	}
+	for j := range tlds {
+		jobs <- j
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	for _, result := range results {
+		for _, entry := range result.explicit {
+			explicit = append(explicit, entry[1:])
+		}
+		for _, entry := range result.unused {
+			unused = append(unused, entry[1:])
+		}
+	}
+	return
+}
+
+// RedundantEntry is a whitelist entry which is covered by another one, see
+// LintWhitelist.
+type RedundantEntry struct {
+	Entry, CoveredBy string
+}
+
+// LintWhitelist finds the entries of a personal whitelist, as returned by
+// ReadList, which have no effect on “domains”.  An entry is redundant if it is
+// covered by another entry, i.e. it is a subdomain of it, or a repetition of
+// it.  Of repeated entries, only the later ones are reported.  An entry is
+// orphaned if there are no blacklisted domains of its TLD at all in “domains”,
+// including entries whose TLD cannot be determined.  Both are returned in the
+// order of “entries”.  Removal entries, which ApplyWhitelist ignores anyway,
+// are skipped.
+func LintWhitelist(domains *Domains, entries []string) (redundant []RedundantEntry, orphans []string) {
+	// first maps every entry to the index of its first occurrence.
+	first := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if _, ok := first[entry]; !ok {
+			first[entry] = i
+		}
+	}
+	for i, entry := range entries {
+		if strings.HasPrefix(entry, "-") {
+			continue
+		}
+		if first[entry] != i {
+			redundant = append(redundant, RedundantEntry{entry, entry})
+			continue
+		}
+		domain, wildcard := strings.CutPrefix("."+entry, ".*")
+		if coveredBy := coveringEntry(first, domain, wildcard); coveredBy != "" {
+			redundant = append(redundant, RedundantEntry{entry, coveredBy})
+			continue
+		}
+		tld, err := getTLD(domain)
+		if err != nil || len(domains.byTLD[tld]) == 0 {
+			orphans = append(orphans, entry)
+		}
+	}
+	return
+}
+
+// coveringEntry returns the whitelist entry in “entries” which covers
+// “domain”, or the empty string if there is none.  “domain” has the leading
+// “.”, and “wildcard” tells whether it stems from a wildcard entry.  A plain
+// entry covers its subdomains, a wildcard entry only the subdomains of its
+// domain, but not the domain itself.  Thus, an entry never covers itself.
+func coveringEntry(entries map[string]int, domain string, wildcard bool) string {
+	for parent := domain; ; {
+		if parent != domain || wildcard {
+			if _, ok := entries[parent[1:]]; ok {
+				return parent[1:]
+			}
+		}
+		if parent != domain {
+			if _, ok := entries["*"+parent]; ok {
+				return "*" + parent
+			}
+		}
+		i := strings.IndexByte(parent[1:], '.')
+		if i < 0 {
+			return ""
+		}
+		parent = parent[i+1:]
+	}
+}
+
+// ApplyWhitelistExact removes the entries of a personal whitelist, as returned
+// by ReadList, from “domains”, but unlike ApplyWhitelist, not their subdomains.
+// It returns the entries that are subdomains of other blacklisted domains in
+// “explicit”, and the entries which had no effect at all in “unused”, both in
+// the order of “entries”.  Output formats matching subdomains, like the one of
+// dnsmasq, unblock the subdomains of explicitly whitelisted domains, too.
+// Therefore, the blacklisted subdomains of such an entry are exempt from being
+// minimised away by a domain above the entry, see MinimizeStream, so that they
+// stay blocked.  Other subdomains get unblocked, which is logged as a warning.
+// Wildcard and removal entries, as well as entries whose TLD cannot be
+// determined, are skipped with a warning.  Domains matching a pattern set with
+// SetKeepPatterns are never removed.
+func ApplyWhitelistExact(domains *Domains, entries []string, logger tbr_logging.Logger) (explicit, unused []string) {
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "-") || strings.HasPrefix(entry, "*.") {
+			logger.Warn("Ignoring wildcard or removal entry in exact whitelist", "entry", entry)
+			continue
+		}
+		domain := "." + entry
+		tld, err := getTLD(domain)
+		if err != nil {
+			logger.Warn("Ignoring whitelist entry", "entry", entry, "error", err)
+			continue
+		}
+		var removed bool
+		subdomains := domains.byTLD[tld]
+		if _, ok := subdomains[domain]; ok {
+			if domains.isKept(domain) {
+				logger.Debug("Keep domain despite whitelisting", "entry", entry, "domain", entry)
+			} else {
+				delete(subdomains, domain)
+				delete(domains.sources, domain)
+				removed = true
+			}
+		}
+		if parent := domains.coveringDomain(tld, domain); parent != "" && parent != domain {
+			logger.Warn("Exact whitelist entry is covered by a blacklisted domain; its subdomains which are "+
+				"not blacklisted themselves get unblocked, too, in output formats matching subdomains",
+				"entry", entry, "coveredBy", parent[1:])
+			if _, exists := domains.exempt[tld]; !exists {
+				domains.exempt[tld] = make(map[string]struct{})
+			}
+			domains.exempt[tld][domain] = struct{}{}
+			explicit = append(explicit, entry)
+		} else if !removed {
+			unused = append(unused, entry)
+		}
+	}
+	return
+}
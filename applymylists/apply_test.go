@@ -0,0 +1,350 @@
+package applymylists
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestApplyWhitelistUnicode(t *testing.T) {
+	domains := readTestDomains(t, "xn--bcher-kva.com", "shop.xn--bcher-kva.com", "other.com")
+	entries, err := ReadList(strings.NewReader("Bücher.com\n"), ReadOptions{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ApplyWhitelist(context.Background(), domains, entries, 1, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"other.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestApplyWhitelistConcurrent applies a whitelist covering many TLDs with many
+// workers, which must give the same result as with a single one.  Run with
+// “-race”, it checks that every set of subdomains is owned by one goroutine.
+func TestApplyWhitelistConcurrent(t *testing.T) {
+	domains := generateDomains(20000)
+	var entries []string
+	for i := 0; i < len(domains); i += 7 {
+		entries = append(entries, domains[i])
+	}
+	var results [][]string
+	for _, workers := range []int{1, 16} {
+		set := readTestDomains(t, domains...)
+		if _, _, err := ApplyWhitelist(context.Background(), set, entries, workers, discardLogger); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, sortedAll(set))
+	}
+	if !slices.Equal(results[0], results[1]) {
+		t.Errorf("got %d domains with 16 workers, want %d", len(results[1]), len(results[0]))
+	}
+	if total := readTestDomains(t, domains...).Len(); len(results[0]) == 0 || len(results[0]) == total {
+		t.Errorf("whitelist left %d of %d domains", len(results[0]), total)
+	}
+}
+
+func TestApplyWhitelistUnused(t *testing.T) {
+	domains := readTestDomains(t, "ads.example.com", "evil.example.org")
+	explicit, unused, err := ApplyWhitelist(context.Background(), domains,
+		[]string{"ads.example.com", "stale.example.com", "gone.example.net"}, 1, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(unused)
+	if want := []string{"gone.example.net", "stale.example.com"}; !slices.Equal(unused, want) {
+		t.Errorf("got unused entries %q, want %q", unused, want)
+	}
+	if len(explicit) != 0 {
+		t.Errorf("got explicit entries %q, want none", explicit)
+	}
+}
+
+func BenchmarkApplyWhitelist(b *testing.B) {
+	domains := generateDomains(100000)
+	var entries []string
+	for i := 0; i < len(domains); i += 100 {
+		entries = append(entries, domains[i])
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		set := readTestDomains(b, domains...)
+		b.StartTimer()
+		if _, _, err := ApplyWhitelist(context.Background(), set, entries, 0, discardLogger); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkApplyWhitelistWorkers applies a large whitelist of 20,000 entries
+// with different numbers of workers, each of which applies the entries of one
+// TLD after the other.
+func BenchmarkApplyWhitelistWorkers(b *testing.B) {
+	domains := generateDomains(200000)
+	var entries []string
+	for i := 0; i < len(domains); i += 10 {
+		entries = append(entries, domains[i])
+	}
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				set := readTestDomains(b, domains...)
+				b.StartTimer()
+				if _, _, err := ApplyWhitelist(context.Background(), set, entries, workers, discardLogger); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	blacklist := []string{"evil.example.com", "ads.example.org", "ads.example.org"}
+	whitelist := []string{"good.example.com", "ads.example.org"}
+	if got, want := Conflicts(blacklist, whitelist), []string{"ads.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyWhitelistKeepPatterns(t *testing.T) {
+	patterns, err := ReadPatterns(strings.NewReader(
+		"# keep numbered ad servers\n^ads[0-9]+\\.tracker\\.example$\n\n^metrics\\.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domains := readTestDomains(t, "ads1.tracker.example", "ads.tracker.example", "ads22.tracker.example",
+		"cdn.tracker.example", "metrics.tracker.example", "metrics.other.example")
+	domains.SetKeepPatterns(patterns)
+	if _, _, err := ApplyWhitelist(context.Background(), domains, []string{"tracker.example"}, 1,
+		discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ads1.tracker.example", "ads22.tracker.example", "metrics.other.example",
+		"metrics.tracker.example"}
+	if got := sortedAll(domains); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadPatternsInvalid(t *testing.T) {
+	_, err := ReadPatterns(strings.NewReader("^ads\\.\n^ads[0-9\n"))
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 2 {
+		t.Errorf("got error %v, want a ParseError in line 2", err)
+	}
+}
+
+func TestApplyListsNoTLD(t *testing.T) {
+	domains := readTestDomains(t, "ads.example.com")
+	logger := new(testLogger)
+	ApplyBlacklist(domains, []string{"localhost", "com", "evil.example.org"}, "blacklist", 1, logger)
+	if got := len(logger.warnings); got != 2 {
+		t.Errorf("got %d warnings, want 2 for the entries without TLD: %q", got, logger.warnings)
+	}
+	logger = new(testLogger)
+	if _, _, err := ApplyWhitelist(context.Background(), domains, []string{"localhost", "ads.example.com"}, 1,
+		logger); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.warned("Ignoring whitelist entry") {
+		t.Errorf("got warnings %q, want one for “localhost”", logger.warnings)
+	}
+	if got, want := sortedAll(domains), []string{"evil.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyBlacklistRedundant(t *testing.T) {
+	domains := readTestDomains(t, "example.com", "tracker.example.org")
+	logger := new(testLogger)
+	ApplyBlacklist(domains, []string{"ads.example.com", "tracker.example.org", "new.example.net"}, "blacklist", 1,
+		logger)
+	for _, want := range []string{"Blacklist entry is redundant", "Blacklist entry is already present"} {
+		if !slices.Contains(logger.debugs, want) {
+			t.Errorf("got debug messages %q, want %q", logger.debugs, want)
+		}
+	}
+	if !slices.Contains(logger.infos, "Some blacklist entries are already covered") {
+		t.Errorf("got info messages %q, want the number of covered entries", logger.infos)
+	}
+	if len(logger.debugs) != 2 {
+		t.Errorf("got debug messages %q, want only two", logger.debugs)
+	}
+}
+
+func TestApplyWhitelistWildcard(t *testing.T) {
+	for _, test := range []struct {
+		entry string
+		want  []string
+	}{
+		{"cdn.example.com", []string{"other.example.com", "xcdn.example.com"}},
+		{"*.cdn.example.com", []string{"cdn.example.com", "other.example.com", "xcdn.example.com"}},
+	} {
+		domains := readTestDomains(t, "cdn.example.com", "a.cdn.example.com", "b.a.cdn.example.com",
+			"other.example.com", "xcdn.example.com")
+		entries, err := ReadList(strings.NewReader(test.entry+"\n"), ReadOptions{Strict: true}, discardLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := ApplyWhitelist(context.Background(), domains, entries, 1, discardLogger); err != nil {
+			t.Fatal(err)
+		}
+		if got := sortedAll(domains); !slices.Equal(got, test.want) {
+			t.Errorf("%v: got %q, want %q", test.entry, got, test.want)
+		}
+	}
+}
+
+func TestApplyBlacklistRemoval(t *testing.T) {
+	domains := readTestDomains(t, "ads.example.com", "x.ads.example.com", "tracker.example.org")
+	entries, err := ReadList(strings.NewReader("evil.example.net\n-ads.example.com\n-none.example.com\n"),
+		ReadOptions{Strict: true}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ApplyBlacklist(domains, entries, "blacklist", 1, discardLogger)
+	want := []string{"evil.example.net", "tracker.example.org", "x.ads.example.com"}
+	if got := sortedAll(domains); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	ApplyBlacklist(domains, []string{"ads.example.com", "-ads.example.com", "ads.example.com"}, "blacklist", 1,
+		discardLogger)
+	if !slices.Contains(sortedAll(domains), "ads.example.com") {
+		t.Error("later entry did not undo the earlier removal")
+	}
+}
+
+func TestApplyBlacklistOverlap(t *testing.T) {
+	domains := readTestDomains(t, "ads.example.com", "example.org", "tracker.example.net")
+	logger := new(testLogger)
+	ApplyBlacklist(domains, []string{"ads.example.com", "x.example.org", "y.example.org", "new.example.com",
+		"evil.example.net"}, "blacklist", 1, logger)
+	want := "[number 3 total 5 present 1 belowParent 2]"
+	if got := fmt.Sprint(logger.args["Some blacklist entries are already covered"]); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestApplyBlacklistOverlappingLists checks that only domains of the large
+// blacklist count as already covered, not those of an earlier personal list.
+func TestApplyBlacklistOverlappingLists(t *testing.T) {
+	domains := readTestDomains(t, "tracker.example.net")
+	ApplyBlacklist(domains, []string{"ads.example.com", "example.org"}, "first", 1, discardLogger)
+	logger := new(testLogger)
+	ApplyBlacklist(domains, []string{"ads.example.com", "x.example.org", "tracker.example.net", "ads.example.com"},
+		"second", 1, logger)
+	want := "[number 1 total 4 present 1 belowParent 0]"
+	if got := fmt.Sprint(logger.args["Some blacklist entries are already covered"]); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want = "[ads.example.com example.org tracker.example.net x.example.org]"
+	if got := fmt.Sprint(sortedAll(domains)); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestApplyBlacklistConcurrent applies many entries of the same TLDs with
+// several workers.  Run it with -race.
+func TestApplyBlacklistConcurrent(t *testing.T) {
+	var entries []string
+	for i := 0; i < 50; i++ {
+		entries = append(entries, generateSubdomains(fmt.Sprintf("example%d.com", i%5), 200)...)
+		entries = append(entries, fmt.Sprintf("ads.site%d.org", i))
+	}
+	for i := 0; i < 20; i++ {
+		entries = append(entries, fmt.Sprintf("-h%d0.example0.com", i))
+	}
+	var results [][]string
+	for _, workers := range []int{1, 8} {
+		domains := readTestDomains(t, "example1.com", "x.example2.com", "tracker.example3.com")
+		ApplyBlacklist(domains, entries, "blacklist", workers, discardLogger)
+		results = append(results, sortedAll(domains))
+	}
+	if !slices.Equal(results[0], results[1]) {
+		t.Errorf("got %d domains with 8 workers, %d with one", len(results[1]), len(results[0]))
+	}
+	if slices.Contains(results[1], "h100.example0.com") || !slices.Contains(results[1], "h100.example1.com") {
+		t.Error("removal entries were not applied after the additions of the same TLD")
+	}
+}
+
+func TestLintWhitelist(t *testing.T) {
+	domains := readTestDomains(t, "ads.example.com", "tracker.example.org")
+	entries := []string{"example.com", "cdn.example.com", "nothing.example.net", "example.com", "-ads.example.com",
+		"tracker.example.org"}
+	redundant, orphans := LintWhitelist(domains, entries)
+	wantRedundant := []RedundantEntry{{"cdn.example.com", "example.com"}, {"example.com", "example.com"}}
+	if !slices.Equal(redundant, wantRedundant) {
+		t.Errorf("got redundant entries %v, want %v", redundant, wantRedundant)
+	}
+	if want := []string{"nothing.example.net"}; !slices.Equal(orphans, want) {
+		t.Errorf("got orphans %q, want %q", orphans, want)
+	}
+}
+
+func TestApplyWhitelistExact(t *testing.T) {
+	input := []string{"foo.example.com", "bad.foo.example.com", "other.example.org"}
+	domains := readTestDomains(t, input...)
+	explicit, unused := ApplyWhitelistExact(domains, []string{"foo.example.com", "missing.example.com"}, discardLogger)
+	if len(explicit) != 0 {
+		t.Errorf("got explicit entries %q, want none", explicit)
+	}
+	if want := []string{"missing.example.com"}; !slices.Equal(unused, want) {
+		t.Errorf("got unused entries %q, want %q", unused, want)
+	}
+	if got, want := sortedAll(domains), []string{"bad.foo.example.com", "other.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("exact whitelist: got %q, want %q", got, want)
+	}
+
+	domains = readTestDomains(t, input...)
+	if _, _, err := ApplyWhitelist(context.Background(), domains, []string{"foo.example.com"}, 1,
+		discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"other.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("subtree whitelist: got %q, want %q", got, want)
+	}
+}
+
+func TestApplyWhitelistExactCovered(t *testing.T) {
+	domains := readTestDomains(t, "example.com", "foo.example.com")
+	logger := new(testLogger)
+	explicit, unused := ApplyWhitelistExact(domains, []string{"foo.example.com"}, logger)
+	if want := []string{"foo.example.com"}; !slices.Equal(explicit, want) {
+		t.Errorf("got explicit entries %q, want %q", explicit, want)
+	}
+	if len(unused) != 0 {
+		t.Errorf("got unused entries %q", unused)
+	}
+	if !logger.warned("Exact whitelist entry is covered") {
+		t.Error("covered entry was not warned about")
+	}
+	if got, want := sortedAll(domains), []string{"example.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestApplyWhitelistExactCoveredSubdomains checks that blacklisted subdomains
+// of an explicitly whitelisted entry survive the minimisation, so that they
+// stay blocked although the entry unblocks its subdomains in dnsmasq.
+func TestApplyWhitelistExactCoveredSubdomains(t *testing.T) {
+	domains := readTestDomains(t, "example.com", "foo.example.com", "bad.foo.example.com", "x.bad.foo.example.com",
+		"other.example.com", "a.bar.foo.example.com", "bar.foo.example.com")
+	ApplyWhitelistExact(domains, []string{"foo.example.com", "bar.foo.example.com"}, discardLogger)
+	minimal, err := Minimize(context.Background(), domains, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.bar.foo.example.com", "bad.foo.example.com", "example.com"}
+	if !slices.Equal(minimal, want) {
+		t.Errorf("got %q, want %q", minimal, want)
+	}
+}
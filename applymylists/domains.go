@@ -0,0 +1,331 @@
+/*
+Package applymylists implements the processing of domain lists behind the
+apply_my_lists program: reading a large blacklist in hosts format, applying
+personal black and whitelists to it, and reducing the result to its minimal
+set of domains, i.e. removing all domains that are subdomains of other
+blacklisted domains.
+
+All domain names are normalised by converting them to lower case and to their
+ASCII (punycode) form.  Internally, they are prepended with a “.”, so that
+subdomain matching can be realised with a simple HasSuffix.  Domains passed to
+or returned by this package never have this leading dot.
+*/
+package applymylists
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Domains is a set of blacklisted domains.  It maps top level domains to a set
+// of domains that belong to this TLD.  (This may include the TLD itself.)  The
+// sets use empty structs as values, which take no memory.  No locking is
+// needed for them because each set is only ever accessed by one goroutine at a
+// time, see ApplyWhitelist.  The zero value is not usable; use NewDomains
+// instead.
+type Domains struct {
+	byTLD map[string]map[string]struct{}
+	// excludedTLDs holds the domains, with leading “.”, below which nothing
+	// is added to the set, see ReadOptions.
+	excludedTLDs []string
+	// onlyTLDs holds the domains, with leading “.”, outside of which nothing
+	// is added to the set, see ReadOptions.  If it is empty, there is no such
+	// restriction.
+	onlyTLDs []string
+	// keepPatterns holds regular expressions for domains which are never
+	// removed by ApplyWhitelist.
+	keepPatterns []*regexp.Regexp
+	// sources maps domains, with leading “.”, to the names of the lists
+	// they were found in.  It is nil if sources are not tracked, see
+	// ReadOptions.
+	sources map[string][]string
+	// added maps TLDs to the domains, with leading “.”, which ApplyBlacklist
+	// added to the set rather than found in it.  The sets are created before
+	// ApplyBlacklist starts its goroutines, like those of byTLD.
+	added map[string]map[string]struct{}
+	// exempt maps TLDs to the domains, with leading “.”, which
+	// ApplyWhitelistExact whitelisted explicitly below a blacklisted parent
+	// domain.  Their blacklisted subdomains are not minimised away by domains
+	// above them, see minimizeExempt.
+	exempt map[string]map[string]struct{}
+}
+
+// NewDomains returns an empty set of domains.
+func NewDomains() *Domains {
+	return &Domains{byTLD: make(map[string]map[string]struct{}), added: make(map[string]map[string]struct{}),
+		exempt: make(map[string]map[string]struct{})}
+}
+
+// insert adds the given domain, which must already have the leading “.”, to the
+// set of the TLD “tld”, which must have been determined with getTLD.
+func (d *Domains) insert(tld, domain string) {
+	if _, exists := d.byTLD[tld]; !exists {
+		d.byTLD[tld] = make(map[string]struct{})
+	}
+	d.byTLD[tld][domain] = struct{}{}
+}
+
+// coveringDomain returns the domain which already covers “domain”, i.e.
+// “domain” itself or one of its parent domains, if one of them is in the set
+// of the TLD “tld”.  Otherwise, it returns the empty string.  Both “domain” and
+// the result have the leading “.”.
+func (d *Domains) coveringDomain(tld, domain string) string {
+	subdomains := d.byTLD[tld]
+	for {
+		if _, ok := subdomains[domain]; ok {
+			return domain
+		}
+		if domain[1:] == tld {
+			return ""
+		}
+		i := strings.IndexByte(domain[1:], '.')
+		if i < 0 {
+			return ""
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// upstreamCoveringDomain is like coveringDomain, but ignores the domains added
+// by ApplyBlacklist, so that it only finds domains of the large blacklist.
+func (d *Domains) upstreamCoveringDomain(tld, domain string) string {
+	subdomains, added := d.byTLD[tld], d.added[tld]
+	for {
+		if _, ok := subdomains[domain]; ok {
+			if _, ok := added[domain]; !ok {
+				return domain
+			}
+		}
+		if domain[1:] == tld {
+			return ""
+		}
+		i := strings.IndexByte(domain[1:], '.')
+		if i < 0 {
+			return ""
+		}
+		domain = domain[i+1:]
+	}
+}
+
+// isExcluded returns whether “domain”, which must have the leading “.”, is
+// below one of the excluded TLDs, or not below any of the only TLDs.
+func (d *Domains) isExcluded(domain string) bool {
+	for _, tld := range d.excludedTLDs {
+		if isSubdomain(domain, tld) {
+			return true
+		}
+	}
+	if len(d.onlyTLDs) == 0 {
+		return false
+	}
+	for _, tld := range d.onlyTLDs {
+		if isSubdomain(domain, tld) {
+			return false
+		}
+	}
+	return true
+}
+
+// SetKeepPatterns sets regular expressions for domains which must be kept
+// blacklisted even if a whitelist entry covers them.  The patterns are
+// matched against the domain names without the leading “.”, see
+// ApplyWhitelist.
+func (d *Domains) SetKeepPatterns(patterns []*regexp.Regexp) {
+	d.keepPatterns = patterns
+}
+
+// isKept returns whether “domain”, which must have the leading “.”, matches
+// one of the keep patterns.
+func (d *Domains) isKept(domain string) bool {
+	for _, pattern := range d.keepPatterns {
+		if pattern.MatchString(domain[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// addSource records that “domain”, which must have the leading “.”, was found
+// in the list “source”.  It does nothing if sources are not tracked.
+func (d *Domains) addSource(domain, source string) {
+	if d.sources == nil {
+		return
+	}
+	if slices.Contains(d.sources[domain], source) {
+		return
+	}
+	d.sources[domain] = append(d.sources[domain], source)
+}
+
+// Sources returns the names of the lists “domain” was found in, in the order
+// in which they were read.  It returns nil if sources are not tracked, see
+// ReadOptions.
+func (d *Domains) Sources(domain string) []string {
+	return d.sources["."+domain]
+}
+
+// Merge adds all domains of “other” to the set, e.g. those of another large
+// blacklist read with ReadDomains.  The sources of the domains are merged, too,
+// if they are tracked in both sets.  It returns the number of domains which
+// were not in the set before.  “other” must not be used afterwards.
+func (d *Domains) Merge(other *Domains) (numberNew int) {
+	for tld, subdomains := range other.byTLD {
+		if _, exists := d.byTLD[tld]; !exists {
+			d.byTLD[tld] = subdomains
+			numberNew += len(subdomains)
+			continue
+		}
+		for domain := range subdomains {
+			if _, exists := d.byTLD[tld][domain]; !exists {
+				d.byTLD[tld][domain] = struct{}{}
+				numberNew++
+			}
+		}
+	}
+	if d.sources != nil && other.sources != nil {
+		for domain, sources := range other.sources {
+			for _, source := range sources {
+				d.addSource(domain, source)
+			}
+		}
+	}
+	return
+}
+
+// Len returns the total number of domains in the set.
+func (d *Domains) Len() (number int) {
+	for _, subdomains := range d.byTLD {
+		number += len(subdomains)
+	}
+	return
+}
+
+// All returns all domains in the set, without the leading “.”, in no particular
+// order.
+func (d *Domains) All() []string {
+	all := make([]string, 0, d.Len())
+	for _, subdomains := range d.byTLD {
+		for domain := range subdomains {
+			all = append(all, domain[1:])
+		}
+	}
+	return all
+}
+
+// TLDCounts returns the number of domains for every TLD in the set.  TLDs
+// without domains, e.g. because all were whitelisted, are left out.
+func (d *Domains) TLDCounts() map[string]int {
+	counts := make(map[string]int, len(d.byTLD))
+	for tld, subdomains := range d.byTLD {
+		if len(subdomains) > 0 {
+			counts[tld] = len(subdomains)
+		}
+	}
+	return counts
+}
+
+// NumberTLDs returns the number of different TLDs in the set.
+func (d *Domains) NumberTLDs() int {
+	return len(d.byTLD)
+}
+
+// ErrNoTLD is returned if the TLD of a domain cannot be determined, see
+// getTLD.  Domains for which this happens are skipped with a warning.
+var ErrNoTLD = errors.New("Could not extract TLD")
+
+// getTLD extracts the top level domain from the given domain.  Here, “top
+// level domain” means the registrable domain according to the ICANN section of
+// the Public Suffix List, i.e. the public suffix plus one label, e.g.
+// “example.co.uk” for “.foo.example.co.uk”.  The private section, with
+// suffixes like “github.io” or “duckdns.org”, is ignored: such a suffix is a
+// registrable domain itself, so that blacklisting it covers all of its
+// subdomains.  The given domain must start with a “.”, the result does not.  It
+// returns ErrNoTLD if there is no registrable domain to extract, e.g. because
+// the domain has only one label like “localhost”, is an ICANN public suffix
+// itself, or is empty.
+func getTLD(domain string) (string, error) {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("%w from “%v”: too few labels", ErrNoTLD, domain)
+	}
+	suffix, icann := publicsuffix.PublicSuffix(domain)
+	for !icann {
+		// Either a private suffix, or an unlisted TLD matched by the default
+		// rule, which has no parent to fall back to.
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix, icann = publicsuffix.PublicSuffix(suffix[i+1:])
+	}
+	if domain == suffix {
+		return "", fmt.Errorf("%w from “%v”: is a public suffix", ErrNoTLD, domain)
+	}
+	i := strings.LastIndexByte(domain[:len(domain)-len(suffix)-1], '.')
+	return domain[i+1:], nil
+}
+
+// subdomainDepth returns the number of labels of “domain”, which must have the
+// leading “.”, in front of its TLD “tld”, as determined with getTLD.  For
+// example, it is 2 for “.a.b.example.co.uk”, and 0 for “.example.co.uk”.
+func subdomainDepth(domain, tld string) int {
+	return strings.Count(domain, ".") - strings.Count(tld, ".") - 1
+}
+
+// validateDomain checks whether “domain”, given without the leading “.”, is a
+// syntactically valid domain name.  It must consist of labels of 1 to 63
+// characters, separated by dots, and must not be longer than 253 characters.
+// Labels may contain ASCII letters, digits, hyphens, and underscores, but must
+// not start or end with a hyphen.
+func validateDomain(domain string) error {
+	if len(domain) > 253 {
+		return fmt.Errorf("Domain “%v” is longer than 253 characters", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return fmt.Errorf("Domain “%v” contains an empty label", domain)
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("Domain “%v” contains a label longer than 63 characters", domain)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("Domain “%v” contains a label starting or ending with a hyphen", domain)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("Domain “%v” contains the invalid character “%c”", domain, c)
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeDomain returns the canonical form of “domain”, as used throughout
+// this package: It is converted to lower case, and internationalised domain
+// names are converted to their ASCII (punycode) form, so that e.g.
+// “bücher.example” and “xn--bcher-kva.example” are the same.  A trailing “.”
+// of a fully qualified domain name like “evil.example.” is removed.  It returns
+// an error if the result is not a valid domain name, see validateDomain.
+func NormalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	asciiDomain, err := idna.Punycode.ToASCII(strings.ToLower(domain))
+	if err != nil {
+		return "", fmt.Errorf("Could not convert domain “%v” to punycode: %w", domain, err)
+	}
+	return asciiDomain, validateDomain(asciiDomain)
+}
+
+// isSubdomain returns whether “domain” is a subdomain of “other” or equal to
+// it.  Both must start with a “.”, as all domains in this package do.  This
+// leading dot is what makes a plain suffix check respect label boundaries:
+// “.notexample.com” does not end in “.example.com”, and neither does
+// “.ample.com” end in “.example.com”.
+func isSubdomain(domain, other string) bool {
+	return strings.HasSuffix(domain, other)
+}
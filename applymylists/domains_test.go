@@ -0,0 +1,133 @@
+package applymylists
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGetTLD(t *testing.T) {
+	for _, test := range []struct {
+		domain, tld string
+	}{
+		{".example.com", "example.com"},
+		{".a.b.example.com", "example.com"},
+		{".foo.co.uk", "foo.co.uk"},
+		{".bar.example.co.uk", "example.co.uk"},
+		{".github.io", "github.io"},
+		{".user.github.io", "github.io"},
+		{".pages.user.github.io", "github.io"},
+		{".duckdns.org", "duckdns.org"},
+		{".evil.duckdns.org", "duckdns.org"},
+		{".x.y.compute.amazonaws.com", "amazonaws.com"},
+		{".foo.example.zz", "example.zz"},
+	} {
+		tld, err := getTLD(test.domain)
+		if err != nil {
+			t.Errorf("getTLD(%q): %v", test.domain, err)
+		} else if tld != test.tld {
+			t.Errorf("getTLD(%q) = %q, want %q", test.domain, tld, test.tld)
+		}
+	}
+}
+
+func TestGetTLDError(t *testing.T) {
+	for _, domain := range []string{"", ".", ".localhost", ".com", ".co.uk"} {
+		if tld, err := getTLD(domain); !errors.Is(err, ErrNoTLD) {
+			t.Errorf("getTLD(%q) = %q, %v, want ErrNoTLD", domain, tld, err)
+		}
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	for _, domain := range []string{"example.com", "a.b-c.example.com", "_dmarc.example.com", "xn--bcher-kva.example",
+		strings.Repeat("a", 63) + ".com"} {
+		if err := validateDomain(domain); err != nil {
+			t.Errorf("validateDomain(%q): %v", domain, err)
+		}
+	}
+	for _, domain := range []string{"", "example..com", ".example.com", "exa mple.com", "-example.com",
+		"example-.com", strings.Repeat("a", 64) + ".com", strings.Repeat("abcdefghi.", 26) + "com",
+		"bücher.example"} {
+		if err := validateDomain(domain); err == nil {
+			t.Errorf("validateDomain(%q) did not fail", domain)
+		}
+	}
+}
+
+func TestIsSubdomain(t *testing.T) {
+	for _, test := range []struct {
+		domain, other string
+		want          bool
+	}{
+		{".example.com", ".example.com", true},
+		{".a.example.com", ".example.com", true},
+		{".a.b.example.com", ".example.com", true},
+		{".ample.com", ".example.com", false},
+		{".example.com", ".ample.com", false},
+		{".notexample.com", ".example.com", false},
+		{".xexample.com", ".example.com", false},
+		{".bad-example.com", ".example.com", false},
+		{".example.com", ".a.example.com", false},
+	} {
+		if got := isSubdomain(test.domain, test.other); got != test.want {
+			t.Errorf("isSubdomain(%q, %q) = %v, want %v", test.domain, test.other, got, test.want)
+		}
+	}
+}
+
+// BenchmarkDomainSets compares the sets of Domains with the sync.Map ones used
+// before on the access pattern of the program: bulk insertion of 1,000,000
+// domains, then ranging over every TLD like cookSubdomains does and deleting
+// every tenth domain like the whitelist does.
+func BenchmarkDomainSets(b *testing.B) {
+	domains := generateDomains(1000000)
+	tlds := make([]string, len(domains))
+	for i, domain := range domains {
+		domains[i] = "." + domain
+		var err error
+		if tlds[i], err = getTLD(domains[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("syncMap", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			byTLD := make(map[string]*sync.Map)
+			for j, domain := range domains {
+				subdomains, ok := byTLD[tlds[j]]
+				if !ok {
+					subdomains = new(sync.Map)
+					byTLD[tlds[j]] = subdomains
+				}
+				subdomains.Store(domain, true)
+			}
+			for _, subdomains := range byTLD {
+				var cooked []string
+				subdomains.Range(func(key, value any) bool {
+					cooked = append(cooked, key.(string))
+					return true
+				})
+				for j := 0; j < len(cooked); j += 10 {
+					subdomains.Delete(cooked[j])
+				}
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			set := NewDomains()
+			for j, domain := range domains {
+				set.insert(tlds[j], domain)
+			}
+			for _, subdomains := range set.byTLD {
+				cooked := cookSubdomains(subdomains)
+				for j := 0; j < len(cooked); j += 10 {
+					delete(subdomains, cooked[j])
+				}
+			}
+		}
+	})
+}
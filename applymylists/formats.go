@@ -0,0 +1,181 @@
+package applymylists
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// InputFormat is the format of the large blacklist read by ReadDomains.
+type InputFormat int
+
+const (
+	// FormatHosts is a hosts file with lines like “0.0.0.0 example.com” or
+	// “:: example.com”.
+	FormatHosts InputFormat = iota
+	// FormatABP is the filter syntax of AdBlock Plus, as used e.g. by
+	// EasyList.  Only rules blocking whole domains, like
+	// “||example.com^”, and their exceptions, like “@@||example.com^”, are
+	// understood.
+	FormatABP
+	// FormatPlain is a list with one domain per line, like the personal
+	// lists.
+	FormatPlain
+	// FormatAuto makes ReadDomains guess the format from the first lines of
+	// the input, see detectFormat.
+	FormatAuto
+)
+
+func (f InputFormat) String() string {
+	switch f {
+	case FormatHosts:
+		return "hosts"
+	case FormatABP:
+		return "abp"
+	case FormatPlain:
+		return "plain"
+	case FormatAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("InputFormat(%d)", int(f))
+}
+
+// sniffLines is the number of non-comment lines detectFormat looks at.
+const sniffLines = 10
+
+// detectFormat guesses the format of the large blacklist from “sample”, its
+// beginning.  Of the first lines which are neither empty nor “#” comments, a
+// line starting with an IP address counts for FormatHosts, a line starting
+// with “||”, “@@”, “!”, or “[Adblock” for FormatABP, and any other line for
+// FormatPlain.  The format with the most lines wins; in case of a tie,
+// FormatHosts is preferred over FormatABP, which is preferred over
+// FormatPlain.
+func detectFormat(sample []byte) InputFormat {
+	var numberHosts, numberABP, numberPlain int
+	for _, line := range strings.Split(string(sample), "\n") {
+		if numberHosts+numberABP+numberPlain == sniffLines {
+			break
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") || strings.HasPrefix(line, "!") ||
+			strings.HasPrefix(line, "[Adblock"):
+			numberABP++
+		case net.ParseIP(strings.Fields(line)[0]) != nil:
+			numberHosts++
+		default:
+			numberPlain++
+		}
+	}
+	switch {
+	case numberHosts >= numberABP && numberHosts >= numberPlain:
+		return FormatHosts
+	case numberABP >= numberPlain:
+		return FormatABP
+	}
+	return FormatPlain
+}
+
+// errUnsupportedRule is returned by a line parser for lines which are valid
+// in the input format but cannot be expressed by this program.
+var errUnsupportedRule = errors.New("Unsupported rule")
+
+// errCosmeticRule is returned by parseABPLine for element hiding rules.
+var errCosmeticRule = errors.New("Cosmetic rule")
+
+// hostRegexp matches a line in a hosts file.  The common IPv4 and IPv6 sink
+// addresses are accepted, and a trailing comment is ignored.  The only group
+// captures the bare domain name.  Hosts files often contain a domain both with
+// an IPv4 and an IPv6 sink address; since domains are stored in sets, it ends
+// up only once in the result anyway.
+var hostRegexp = regexp.MustCompile(`^\s*(?:0\.0\.0\.0|127\.0\.0\.1|::|::0|::1)\s+([^\s#]+)\s*(?:#.*)?$`)
+
+// parseHostsLine returns the domain of “line”, which is a non-empty,
+// non-comment line of a hosts file.  “exception” is always false.
+func parseHostsLine(line string) (domain string, exception bool, err error) {
+	return parseHostsLineWith(hostRegexp, line)
+}
+
+// parseHostsLineWith is parseHostsLine with “re” instead of hostRegexp, see
+// “ReadOptions.HostRegexp”.  “re” must have exactly one group, which captures
+// the domain.
+func parseHostsLineWith(re *regexp.Regexp, line string) (domain string, exception bool, err error) {
+	match := re.FindStringSubmatch(line)
+	if match == nil {
+		return "", false, errors.New("Invalid line")
+	}
+	return match[1], false, nil
+}
+
+// checkHostRegexp returns an error if “re” cannot be used as
+// “ReadOptions.HostRegexp”.
+func checkHostRegexp(re *regexp.Regexp) error {
+	if re != nil && re.NumSubexp() != 1 {
+		return fmt.Errorf("Host regexp “%v” must have exactly one group, not %d", re, re.NumSubexp())
+	}
+	return nil
+}
+
+// dateLayout is the layout of the dates in trailing comments, see lineDate.
+const dateLayout = "2006-01-02"
+
+// lineDate returns the date at the beginning of the trailing comment of “line”,
+// e.g. 2024-06-01 for “0.0.0.0 evil.example # 2024-06-01”, which is the date
+// the domain was added to the list.  “ok” is false if there is no comment or if
+// it does not start with a date in the form YYYY-MM-DD.
+func lineDate(line string) (date time.Time, ok bool) {
+	_, comment, found := strings.Cut(line, "#")
+	if !found {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(comment)
+	if len(fields) == 0 {
+		return time.Time{}, false
+	}
+	date, err := time.Parse(dateLayout, fields[0])
+	return date, err == nil
+}
+
+// parsePlainLine returns the domain of “line”, which is a non-empty line of a
+// list with one domain per line.  A trailing comment starting with “#” is
+// ignored, and comment lines yield an empty domain.  “exception” is always
+// false.
+func parsePlainLine(line string) (domain string, exception bool, err error) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 0:
+		return "", false, nil
+	case 1:
+		return fields[0], false, nil
+	}
+	return "", false, errors.New("Invalid line")
+}
+
+// abpRegexp matches an ABP rule blocking a whole domain, or an exception for
+// it.  The first group is “@@” for exceptions, the second one captures the
+// domain, the third one the options of the rule, if any.
+var abpRegexp = regexp.MustCompile(`^(@@)?\|\|([^/^$*|]+)\^(\$.*)?$`)
+
+// parseABPLine returns the domain of “line”, which is a non-empty line of an
+// ABP filter list, and whether it is an exception.  Comments and the header
+// yield an empty domain.  Rules with options are unsupported because they
+// restrict the blocking to certain requests.
+func parseABPLine(line string) (domain string, exception bool, err error) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return "", false, nil
+	}
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+		return "", false, errCosmeticRule
+	}
+	match := abpRegexp.FindStringSubmatch(line)
+	if match == nil || match[3] != "" {
+		return "", false, errUnsupportedRule
+	}
+	return match[2], match[1] != "", nil
+}
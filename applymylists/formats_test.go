@@ -0,0 +1,98 @@
+package applymylists
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseHostsLine(t *testing.T) {
+	for _, test := range []struct {
+		line, domain string
+	}{
+		{"0.0.0.0 evil.test", "evil.test"},
+		{"127.0.0.1 evil.test", "evil.test"},
+		{"  0.0.0.0\tevil.test", "evil.test"},
+		{"0.0.0.0 evil.test # comment", "evil.test"},
+		{"127.0.0.1 evil.test#comment", "evil.test"},
+		{":: evil.test", "evil.test"},
+		{"0.0.0.0 tracker.example # ad network", "tracker.example"},
+		{"0.0.0.0 tracker.example#ad network", "tracker.example"},
+		{"0.0.0.0 tracker.example   \t", "tracker.example"},
+		{"0.0.0.0\t\ttracker.example\t# ad network\t", "tracker.example"},
+		{"0.0.0.0 tracker.example#", "tracker.example"},
+	} {
+		domain, exception, err := parseHostsLine(test.line)
+		if err != nil {
+			t.Errorf("parseHostsLine(%q): %v", test.line, err)
+		} else if domain != test.domain || exception {
+			t.Errorf("parseHostsLine(%q) = %q, %v, want %q, false", test.line, domain, exception, test.domain)
+		}
+	}
+	for _, line := range []string{"evil.test", "1.2.3.4 evil.test", "0.0.0.0 evil.test other.test"} {
+		if _, _, err := parseHostsLine(line); err == nil {
+			t.Errorf("parseHostsLine(%q) did not fail", line)
+		}
+	}
+}
+
+func TestParseABPLine(t *testing.T) {
+	for _, test := range []struct {
+		line, domain string
+		exception    bool
+		err          error
+	}{
+		{"||doubleclick.net^", "doubleclick.net", false, nil},
+		{"@@||good.example^", "good.example", true, nil},
+		{"! Title: EasyList", "", false, nil},
+		{"[Adblock Plus 2.0]", "", false, nil},
+		{"example.com##.ad-banner", "", false, errCosmeticRule},
+		{"example.com#@#.ad-banner", "", false, errCosmeticRule},
+		{"||ads.example.com^$third-party", "", false, errUnsupportedRule},
+		{"/banner/*/img^", "", false, errUnsupportedRule},
+	} {
+		domain, exception, err := parseABPLine(test.line)
+		if !errors.Is(err, test.err) {
+			t.Errorf("parseABPLine(%q): got error %v, want %v", test.line, err, test.err)
+		} else if domain != test.domain || exception != test.exception {
+			t.Errorf("parseABPLine(%q) = %q, %v, want %q, %v", test.line, domain, exception, test.domain,
+				test.exception)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, test := range []struct {
+		sample string
+		format InputFormat
+	}{
+		{"# hosts\n0.0.0.0 ads.example.com\n127.0.0.1 evil.example.org\n", FormatHosts},
+		{":: ads.example.com\n", FormatHosts},
+		{"[Adblock Plus 2.0]\n! Title: Test\n||ads.example.com^\n@@||ok.example.org^\n", FormatABP},
+		{"ads.example.com\nevil.example.org\n", FormatPlain},
+		{"# nothing but comments\n\n", FormatHosts},
+	} {
+		if got := detectFormat([]byte(test.sample)); got != test.format {
+			t.Errorf("detectFormat(%q) = %v, want %v", test.sample, got, test.format)
+		}
+	}
+}
+
+func TestLineDate(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		date time.Time
+		ok   bool
+	}{
+		{"0.0.0.0 evil.example # 2024-06-01", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"evil.example #2024-06-01 phishing", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), true},
+		{"0.0.0.0 evil.example", time.Time{}, false},
+		{"0.0.0.0 evil.example # phishing, 2024-06-01", time.Time{}, false},
+		{"0.0.0.0 evil.example # 2024-13-01", time.Time{}, false},
+		{"0.0.0.0 evil.example #", time.Time{}, false},
+	} {
+		if date, ok := lineDate(test.line); !date.Equal(test.date) || ok != test.ok {
+			t.Errorf("lineDate(%q) = %v, %v, want %v, %v", test.line, date, ok, test.date, test.ok)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package applymylists
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// discardLogger is the logger for tests which are not interested in the
+// messages.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// testLogger records the messages logged to it, so that tests can check for
+// them.  It is safe for concurrent use.
+type testLogger struct {
+	mu                      sync.Mutex
+	warnings, infos, debugs []string
+	// args maps messages to the arguments they were logged with last.
+	args map[string][]any
+}
+
+// record appends “msg” to “messages” and records its arguments.
+func (l *testLogger) record(messages *[]string, msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*messages = append(*messages, msg)
+	if l.args == nil {
+		l.args = make(map[string][]any)
+	}
+	l.args[msg] = args
+}
+
+func (l *testLogger) Warn(msg string, args ...any) {
+	l.record(&l.warnings, msg, args)
+}
+
+func (l *testLogger) Info(msg string, args ...any) {
+	l.record(&l.infos, msg, args)
+}
+
+func (l *testLogger) Debug(msg string, args ...any) {
+	l.record(&l.debugs, msg, args)
+}
+
+// warned returns whether a warning starting with “prefix” was logged.
+func (l *testLogger) warned(prefix string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.ContainsFunc(l.warnings, func(msg string) bool { return strings.HasPrefix(msg, prefix) })
+}
+
+// generateDomains returns “n” random domains below “com”.  They belong to about
+// n/10 registrable domains and have up to three labels in front of them, so
+// that there are many subdomains for the minimisation to remove.  The result
+// is the same for every call with the same “n”.
+func generateDomains(n int) []string {
+	rng := rand.New(rand.NewSource(int64(n)))
+	domains := make([]string, n)
+	for i := range domains {
+		domain := fmt.Sprintf("site%d.com", rng.Intn(n/10+1))
+		for depth := rng.Intn(4); depth > 0; depth-- {
+			domain = fmt.Sprintf("s%d.%v", rng.Intn(20), domain)
+		}
+		domains[i] = domain
+	}
+	return domains
+}
+
+// generateSubdomains returns “n” distinct subdomains of “tld”, so that all of
+// them end up in the same group and exceed serialThreshold if “n” is large
+// enough.  Every tenth domain has subdomains among the others.
+func generateSubdomains(tld string, n int) []string {
+	domains := make([]string, n)
+	for i := range domains {
+		if i%10 == 0 {
+			domains[i] = fmt.Sprintf("h%d.%v", i, tld)
+		} else {
+			domains[i] = fmt.Sprintf("s%d.h%d.%v", i, i/10*10, tld)
+		}
+	}
+	return domains
+}
+
+// hostsFile returns “domains” as the content of a hosts file.
+func hostsFile(domains []string) string {
+	var builder strings.Builder
+	for _, domain := range domains {
+		builder.WriteString("0.0.0.0 ")
+		builder.WriteString(domain)
+		builder.WriteByte('\n')
+	}
+	return builder.String()
+}
+
+// readTestDomains returns a set of “domains”, read with ReadDomains.
+func readTestDomains(tb testing.TB, domains ...string) *Domains {
+	tb.Helper()
+	result, _, err := ReadDomains(context.Background(), strings.NewReader(hostsFile(domains)), ReadOptions{},
+		discardLogger)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return result
+}
+
+// sortedAll returns all domains of “domains” in lexical order.
+func sortedAll(domains *Domains) []string {
+	all := domains.All()
+	slices.Sort(all)
+	return all
+}
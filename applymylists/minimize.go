@@ -0,0 +1,281 @@
+package applymylists
+
+import (
+	"cmp"
+	"context"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/maps"
+)
+
+// cookSubdomains simplfies the set of domains of one TLD into a slice.  This
+// makes some operations faster.  It is called after the map has served its
+// purpose to ensure fast lookups and ensure uniqueness.  The domain slice is
+// sorted by length in order to have a reliable breaking condition when looking
+// for subdomains.  (A domain can never be longer than its subdomain.)
+func cookSubdomains(subdomains map[string]struct{}) []string {
+	cooked := maps.Keys(subdomains)
+	slices.SortFunc(cooked, func(a, b string) int {
+		return cmp.Compare(len(a), len(b))
+	})
+	return cooked
+}
+
+// checkDomain returns whether “domain” is not a subdomain of any other
+// blacklisted domain.  The loop here is the hot loop of the program which has
+// to be as performant as possible.  For instance, we make use of the fact that
+// the items in the subdomains slice become longer and longer.
+func checkDomain(subdomains []string, domain string) bool {
+	lenDomain := len(domain)
+	for _, otherDomain := range subdomains {
+		if len(otherDomain) > lenDomain {
+			break
+		}
+		if isSubdomain(domain, otherDomain) && domain != otherDomain {
+			return false
+		}
+	}
+	return true
+}
+
+// checkJob is a work item for checkWorker.  “subdomains” is the sorted slice
+// of all domains of the TLD “domain” belongs to.  “done” is signalled after
+// the job was done.
+type checkJob struct {
+	subdomains []string
+	domain     string
+	done       *sync.WaitGroup
+}
+
+// checkWorker calls checkDomain for every job it receives until the “jobs”
+// channel is closed.  This way, the number of goroutines is bounded by the
+// number of workers rather than the number of domains.  It appends the minimal
+// domains to “minimal”, which belongs to this worker alone, so that the
+// workers never wait for each other.  The caller may read “minimal” once the
+// jobs it is interested in are done.  It increments “numberChecked” for every
+// job done.  Once “done” is closed, the remaining jobs are only signalled as
+// done without being checked.
+func checkWorker(jobs <-chan checkJob, minimal *[]string, numberChecked *atomic.Int64, done <-chan struct{},
+	wg *sync.WaitGroup) {
+	defer wg.Done()
+	for job := range jobs {
+		select {
+		case <-done:
+		default:
+			if checkDomain(job.subdomains, job.domain) {
+				*minimal = append(*minimal, job.domain)
+			}
+			numberChecked.Add(1)
+		}
+		job.done.Done()
+	}
+}
+
+// serialThreshold is the number of domains of a TLD below which it is
+// minimised by minimizeSerial instead of the worker pool.  For such small
+// sets, the overhead of the goroutines outweighs their benefit.
+const serialThreshold = 10000
+
+// reverse returns “s” with its bytes in reverse order.  Since domains are
+// ASCII after normalisation, this reverses the characters.
+func reverse(s string) string {
+	reversed := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		reversed[len(s)-1-i] = s[i]
+	}
+	return string(reversed)
+}
+
+// minimal returns the minimal domains of “domains”, which must have the
+// leading “.”, in no particular order.  It sorts the domains in a new slice by
+// their reversed names.  This way, every domain is directly followed by its
+// subdomains.  Thus, a single pass suffices which keeps a domain only if it is
+// not a subdomain of the domain kept last.  The leading “.” of the domains
+// makes this respect label boundaries, see isSubdomain.  Duplicates in
+// “domains” are returned only once.
+func minimal(domains []string) (result []string) {
+	reversed := make([]string, len(domains))
+	for i, domain := range domains {
+		reversed[i] = reverse(domain)
+	}
+	slices.Sort(reversed)
+	var lastKept string
+	for _, domain := range reversed {
+		if lastKept == "" || !strings.HasPrefix(domain, lastKept) {
+			lastKept = domain
+			result = append(result, reverse(domain))
+		}
+	}
+	return
+}
+
+// Minimal returns the minimal domains of “domains”, i.e. all domains which are
+// not subdomains of any other domain in it, sorted lexically.  “domains” may
+// be in any order, contain duplicates, and belong to different TLDs; it is not
+// modified.  Unlike Minimize, this is a plain function without any goroutines,
+// which is fast enough for small sets of domains.
+func Minimal(domains []string) []string {
+	dotted := make([]string, len(domains))
+	for i, domain := range domains {
+		dotted[i] = "." + domain
+	}
+	result := minimal(dotted)
+	for i, domain := range result {
+		result[i] = domain[1:]
+	}
+	slices.Sort(result)
+	return result
+}
+
+// minimizeSerial is the simple variant of the minimisation for small sets of
+// domains, see minimal.  It increments “numberChecked” by the number of
+// domains.
+func minimizeSerial(subdomains map[string]struct{}, numberChecked *atomic.Int64) []string {
+	numberChecked.Add(int64(len(subdomains)))
+	return minimal(maps.Keys(subdomains))
+}
+
+// minimizeExempt is the variant of minimizeSerial for a TLD with domains
+// whitelisted by ApplyWhitelistExact, given as “exempt”.  It groups the domains
+// by their nearest exempt parent domain, see nearestExempt, and minimises every
+// group on its own.  This way, a blacklisted subdomain of an exempt domain is
+// not minimised away by a domain above the exempt one.
+func minimizeExempt(subdomains, exempt map[string]struct{}, numberChecked *atomic.Int64) (result []string) {
+	numberChecked.Add(int64(len(subdomains)))
+	groups := make(map[string][]string)
+	for domain := range subdomains {
+		parent := nearestExempt(domain, exempt)
+		groups[parent] = append(groups[parent], domain)
+	}
+	for _, group := range groups {
+		result = append(result, minimal(group)...)
+	}
+	return
+}
+
+// nearestExempt returns the nearest parent domain of “domain” in “exempt”, or
+// the empty string if there is none.  “domain” itself does not count.  All
+// domains have the leading “.”.
+func nearestExempt(domain string, exempt map[string]struct{}) string {
+	for {
+		i := strings.IndexByte(domain[1:], '.')
+		if i < 0 {
+			return ""
+		}
+		domain = domain[i+1:]
+		if _, ok := exempt[domain]; ok {
+			return domain
+		}
+	}
+}
+
+// MinimizeStream finds the minimal domains of “domains”, i.e. all domains which
+// are not subdomains of any other domain in the set.  Since a domain can only
+// be a subdomain of a domain with the same TLD, it does so for one TLD after
+// the other, in lexical order of the TLDs.  For every TLD, it calls “yield”
+// with its minimal domains, in no particular order, and removes the TLD from
+// “domains”.  This way, only the minimal domains of one TLD need to be held in
+// memory at the same time.  If “yield” returns an error, MinimizeStream stops
+// and returns it.
+//
+// Blacklisted subdomains of domains whitelisted by ApplyWhitelistExact below a
+// blacklisted parent domain are exempt from the minimisation by domains above
+// them, so that output formats matching subdomains do not unblock them.  TLDs
+// with such domains are processed serially, see minimizeExempt.  Other large
+// TLDs are processed by “workers” goroutines, or as many as there are CPUs if
+// “workers” is less than 1, small ones serially, and TLDs with only one domain
+// are passed through directly.  If “numberChecked” is not nil, it is
+// incremented for every domain checked, so that the caller can report progress.
+// If “ctx” is cancelled, its error is returned.
+func MinimizeStream(ctx context.Context, domains *Domains, workers int, numberChecked *atomic.Int64,
+	yield func(minimal []string) error) error {
+	if numberChecked == nil {
+		numberChecked = new(atomic.Int64)
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	// Every worker collects its minimal domains in its own slice.  They are
+	// merged after all jobs of a TLD are done, and before any job of the next
+	// TLD is sent, so no locking is needed.
+	minimal := make([][]string, workers)
+	jobs := make(chan checkJob)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go checkWorker(jobs, &minimal[i], numberChecked, ctx.Done(), &wg)
+	}
+	defer func() {
+		close(jobs)
+		wg.Wait()
+	}()
+	tlds := maps.Keys(domains.byTLD)
+	slices.Sort(tlds)
+	for _, tld := range tlds {
+		subdomains := domains.byTLD[tld]
+		var result []string
+		if exempt := domains.exempt[tld]; len(exempt) > 0 {
+			result = minimizeExempt(subdomains, exempt, numberChecked)
+		} else if len(subdomains) == 1 {
+			// The most common case for a large blacklist: a lone domain is
+			// trivially minimal.
+			for domain := range subdomains {
+				result = []string{domain}
+			}
+			numberChecked.Add(1)
+		} else if len(subdomains) < serialThreshold {
+			result = minimizeSerial(subdomains, numberChecked)
+		} else {
+			cooked := cookSubdomains(subdomains)
+			var done sync.WaitGroup
+			for _, domain := range cooked {
+				if ctx.Err() != nil {
+					break
+				}
+				done.Add(1)
+				select {
+				case jobs <- checkJob{cooked, domain, &done}:
+				case <-ctx.Done():
+					done.Done()
+				}
+			}
+			done.Wait()
+			for i := range minimal {
+				result = append(result, minimal[i]...)
+				minimal[i] = nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		delete(domains.byTLD, tld)
+		delete(domains.exempt, tld)
+		for i, domain := range result {
+			result[i] = domain[1:]
+		}
+		if err := yield(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Minimize returns the minimal domains of “domains”, see MinimizeStream,
+// sorted by TLD first and then lexically.  Like MinimizeStream, it empties
+// “domains”.
+func Minimize(ctx context.Context, domains *Domains, workers int, numberChecked *atomic.Int64) (
+	minimal []string, err error) {
+	err = MinimizeStream(ctx, domains, workers, numberChecked, func(tldMinimal []string) error {
+		slices.Sort(tldMinimal)
+		minimal = append(minimal, tldMinimal...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
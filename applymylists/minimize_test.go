@@ -0,0 +1,484 @@
+package applymylists
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMinimizeLabelBoundary(t *testing.T) {
+	domains := readTestDomains(t, "example.com", "notexample.com", "xexample.com", "a.example.com")
+	minimal, err := Minimize(context.Background(), domains, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(minimal)
+	if want := []string{"example.com", "notexample.com", "xexample.com"}; !slices.Equal(minimal, want) {
+		t.Errorf("got %q, want %q", minimal, want)
+	}
+}
+
+func TestMinimizePrivateSuffix(t *testing.T) {
+	domains := readTestDomains(t, "duckdns.org", "evil.duckdns.org", "user.github.io", "github.io")
+	minimal, err := Minimize(context.Background(), domains, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(minimal)
+	if want := []string{"duckdns.org", "github.io"}; !slices.Equal(minimal, want) {
+		t.Errorf("got %q, want %q", minimal, want)
+	}
+}
+
+func BenchmarkMinimize(b *testing.B) {
+	for _, fixture := range []struct {
+		name    string
+		domains []string
+	}{
+		{"manyTLDs", generateDomains(100000)},
+		{"oneTLD", generateSubdomains("example.com", 20000)},
+	} {
+		b.Run(fixture.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				set := readTestDomains(b, fixture.domains...)
+				b.StartTimer()
+				if _, err := Minimize(context.Background(), set, 4, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMinimizeWorkers measures the worker pool with 500,000 domains in
+// groups large enough for it.  The memory use does not grow with the number of
+// domains, only with the number of workers.
+func BenchmarkMinimizeWorkers(b *testing.B) {
+	var domains []string
+	for i := 0; i < 25; i++ {
+		domains = append(domains, generateSubdomains(fmt.Sprintf("example%d.com", i), 20000)...)
+	}
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				set := readTestDomains(b, domains...)
+				b.StartTimer()
+				if _, err := Minimize(context.Background(), set, workers, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// collectViaChannel checks the domains of “cooked” like the worker pool of
+// MinimizeStream, but the workers send the minimal domains over a channel with
+// the capacity “capacity” to a single collecting goroutine.  This was the
+// original design, replaced by the per-worker slices of checkWorker, and is
+// kept for BenchmarkMinimizeCollectors.
+func collectViaChannel(cooked []string, workers, capacity int) []string {
+	domains := make(chan string)
+	found := make(chan string, capacity)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range domains {
+				if checkDomain(cooked, domain) {
+					found <- domain
+				}
+			}
+		}()
+	}
+	collected := make(chan []string)
+	go func() {
+		var result []string
+		for domain := range found {
+			result = append(result, domain)
+		}
+		collected <- result
+	}()
+	for _, domain := range cooked {
+		domains <- domain
+	}
+	close(domains)
+	wg.Wait()
+	close(found)
+	return <-collected
+}
+
+// collectViaSlices does the same as collectViaChannel with checkWorker, i.e.
+// every worker appends to its own slice, and the slices are merged at the end.
+func collectViaSlices(cooked []string, workers int) []string {
+	jobs := make(chan checkJob)
+	minimal := make([][]string, workers)
+	var numberChecked atomic.Int64
+	var wg, done sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go checkWorker(jobs, &minimal[i], &numberChecked, nil, &wg)
+	}
+	for _, domain := range cooked {
+		done.Add(1)
+		jobs <- checkJob{cooked, domain, &done}
+	}
+	done.Wait()
+	close(jobs)
+	wg.Wait()
+	var result []string
+	for _, workerMinimal := range minimal {
+		result = append(result, workerMinimal...)
+	}
+	return result
+}
+
+// BenchmarkMinimizeCollectors compares the ways for the workers to hand over
+// the minimal domains of a group of 20,000 domains: an unbuffered and a
+// buffered channel read by a collecting goroutine, and per-worker slices.
+func BenchmarkMinimizeCollectors(b *testing.B) {
+	subdomains := make(map[string]struct{})
+	for _, domain := range generateSubdomains("example.com", 20000) {
+		subdomains["."+domain] = struct{}{}
+	}
+	cooked := cookSubdomains(subdomains)
+	const workers = 4
+	collectors := []struct {
+		name    string
+		collect func() []string
+	}{
+		{"unbuffered", func() []string { return collectViaChannel(cooked, workers, 0) }},
+		{"buffered", func() []string { return collectViaChannel(cooked, workers, 1024) }},
+		{"slices", func() []string { return collectViaSlices(cooked, workers) }},
+	}
+	var want []string
+	for _, collector := range collectors {
+		got := collector.collect()
+		slices.Sort(got)
+		if want == nil {
+			want = got
+		} else if !slices.Equal(got, want) {
+			b.Fatalf("%v: got %d minimal domains, want %d", collector.name, len(got), len(want))
+		}
+	}
+	for _, collector := range collectors {
+		b.Run(collector.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if got := collector.collect(); len(got) != len(want) {
+					b.Fatalf("got %d minimal domains, want %d", len(got), len(want))
+				}
+			}
+		})
+	}
+}
+
+// TestMinimizeStrategies checks that the worker pool and minimal, the serial
+// strategy for small groups, find the same minimal domains.
+func TestMinimizeStrategies(t *testing.T) {
+	domains := generateSubdomains("example.com", serialThreshold)
+	domains = append(domains, "example.com", "xexample.com", "a.xexample.com")
+	set := readTestDomains(t, domains...)
+	if got := len(set.byTLD["example.com"]); got < serialThreshold {
+		t.Fatalf("got %d domains below “example.com”, too few for the worker pool", got)
+	}
+	pooled, err := Minimize(context.Background(), set, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := Minimal(domains); !slices.Equal(pooled, serial) {
+		t.Errorf("worker pool found %q, serial strategy %q", pooled, serial)
+	}
+}
+
+// BenchmarkMinimizeStrategies compares minimal, which sorts all domains by
+// their reversed names, with checkDomain applied to the domains bucketed by
+// TLD, both single-threaded.
+func BenchmarkMinimizeStrategies(b *testing.B) {
+	for _, n := range []int{1000, 100000, 1000000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			set := readTestDomains(b, generateDomains(n)...)
+			var all []string
+			for _, subdomains := range set.byTLD {
+				for domain := range subdomains {
+					all = append(all, domain)
+				}
+			}
+			b.Run("serial", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					minimal(all)
+				}
+			})
+			b.Run("bucketed", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					for _, subdomains := range set.byTLD {
+						cooked := cookSubdomains(subdomains)
+						for _, domain := range cooked {
+							checkDomain(cooked, domain)
+						}
+					}
+				}
+			})
+		})
+	}
+}
+
+// heapBytes returns the bytes occupied by live and not yet swept heap objects.
+// Unlike runtime.ReadMemStats, it does not stop the world, so it can be called
+// often.
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// BenchmarkMinimizeStreamMemory compares the peak heap of MinimizeStream, which
+// lets the caller discard every TLD's minimal domains after writing them, with
+// collecting all of them like Minimize does.  The peak is sampled whenever the
+// minimal domains of a TLD are passed to the caller and reported as
+// “peak-heap-B”, relative to the heap before the minimisation.  The process's
+// RSS cannot be used here because it never shrinks.
+func BenchmarkMinimizeStreamMemory(b *testing.B) {
+	domains := generateDomains(1000000)
+	for _, collect := range []bool{false, true} {
+		name := "stream"
+		if collect {
+			name = "collect"
+		}
+		b.Run(name, func(b *testing.B) {
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				set := readTestDomains(b, domains...)
+				runtime.GC()
+				base := heapBytes()
+				b.StartTimer()
+				var minimal []string
+				err := MinimizeStream(context.Background(), set, 4, nil, func(tldMinimal []string) error {
+					if collect {
+						minimal = append(minimal, tldMinimal...)
+					}
+					if heap := heapBytes(); heap > base && heap-base > peak {
+						peak = heap - base
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-B")
+		})
+	}
+}
+
+// BenchmarkMinimizeSingletons measures how MinimizeStream handles 100,000 TLDs
+// with one domain each, compared with minimizeSerial, which they would be
+// passed to without the fast path.
+func BenchmarkMinimizeSingletons(b *testing.B) {
+	domains := make([]string, 100000)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("ads.site%d.com", i)
+	}
+	set := readTestDomains(b, domains...)
+	var numberChecked atomic.Int64
+	var result []string
+	b.Run("fastPath", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, subdomains := range set.byTLD {
+				for domain := range subdomains {
+					result = []string{domain}
+				}
+				numberChecked.Add(1)
+			}
+		}
+	})
+	b.Run("serial", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, subdomains := range set.byTLD {
+				result = minimizeSerial(subdomains, &numberChecked)
+			}
+		}
+	})
+	_ = result
+}
+
+// TestMinimizeStreamCancel cancels MinimizeStream while the worker pool is busy
+// with a TLD.  Run it with -race.
+func TestMinimizeStreamCancel(t *testing.T) {
+	var domains []string
+	for i := 0; i < 4; i++ {
+		domains = append(domains, generateSubdomains(fmt.Sprintf("example%d.com", i), 2*serialThreshold)...)
+	}
+	set := readTestDomains(t, domains...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var numberChecked atomic.Int64
+	go func() {
+		for numberChecked.Load() < 3*serialThreshold {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	var numberYielded int
+	err := MinimizeStream(ctx, set, 4, &numberChecked, func([]string) error {
+		numberYielded++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if numberYielded >= 4 {
+		t.Errorf("got all %d TLDs despite the cancellation", numberYielded)
+	}
+	if got := len(set.byTLD); got+numberYielded != 4 {
+		t.Errorf("%d TLDs left after %d were yielded, want the others to remain", got, numberYielded)
+	}
+}
+
+// TestMinimizeInsertionOrder checks that the shortest covering domain is kept
+// no matter whether it came from the main list or the blacklist, both for
+// small TLDs and for ones large enough for the worker pool.
+func TestMinimizeInsertionOrder(t *testing.T) {
+	want := []string{"example.com", "evil.example.org"}
+	longer := []string{"ads.example.com", "x.ads.example.com", "a.b.evil.example.org"}
+	shorter := []string{"example.com", "evil.example.org"}
+	for _, large := range []bool{false, true} {
+		longer := longer
+		if large {
+			longer = append(generateSubdomains("example.com", serialThreshold), longer...)
+		}
+		for _, test := range []struct {
+			name             string
+			input, blacklist []string
+		}{
+			{"main list then blacklist", longer, shorter},
+			{"blacklist then main list", shorter, longer},
+		} {
+			domains := readTestDomains(t, test.input...)
+			ApplyBlacklist(domains, test.blacklist, "blacklist", 1, discardLogger)
+			minimal, err := Minimize(context.Background(), domains, 2, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(minimal, want) {
+				t.Errorf("%v, large %v: got %q, want %q", test.name, large, minimal, want)
+			}
+		}
+	}
+}
+
+// TestMinimizeAfterWhitelist whitelists domains in the middle of chains of
+// subdomains, so that the domain shadowing a branch may be gone, and checks
+// that the minimisation keeps no subdomain of another remaining domain.
+func TestMinimizeAfterWhitelist(t *testing.T) {
+	for _, test := range []struct {
+		domains, whitelist, want []string
+	}{
+		{[]string{"b.example.com", "a.b.example.com", "x.a.b.example.com", "y.b.example.com"},
+			[]string{"a.b.example.com"}, []string{"b.example.com"}},
+		{[]string{"a.b.example.com", "x.a.b.example.com", "c.b.example.com", "y.c.b.example.com",
+			"z.y.c.b.example.com"},
+			[]string{"a.b.example.com"}, []string{"c.b.example.com"}},
+		{[]string{"s.example.com", "x.s.example.com", "v.e.r.y.example.com", "l.o.n.g.example.com",
+			"o.n.g.example.com"},
+			[]string{"s.example.com"}, []string{"o.n.g.example.com", "v.e.r.y.example.com"}},
+		{[]string{"y.c.b.example.com", "c.b.example.com", "z.y.c.b.example.com", "w.z.y.c.b.example.com"},
+			[]string{"y.c.b.example.com"}, []string{"c.b.example.com"}},
+		{[]string{"c.b.example.com", "y.c.b.example.com", "z.y.c.b.example.com", "other.example.com"},
+			[]string{"c.b.example.com"}, []string{"other.example.com"}},
+	} {
+		domains := readTestDomains(t, test.domains...)
+		if _, _, err := ApplyWhitelist(context.Background(), domains, test.whitelist, 1, discardLogger); err != nil {
+			t.Fatal(err)
+		}
+		minimal, err := Minimize(context.Background(), domains, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(minimal)
+		if !slices.Equal(minimal, test.want) {
+			t.Errorf("whitelisting %q in %q: got %q, want %q", test.whitelist, test.domains, minimal, test.want)
+		}
+	}
+}
+
+// TestMinimizeAfterWhitelistPooled is like TestMinimizeAfterWhitelist, but with
+// enough domains left for the worker pool.
+func TestMinimizeAfterWhitelistPooled(t *testing.T) {
+	domains := generateSubdomains("example.com", 2*serialThreshold)
+	domains = append(domains, "x.s11.h10.example.com", "y.x.s11.h10.example.com")
+	whitelist := []string{"h10.example.com", "s25.h20.example.com", "s31.h30.example.com"}
+	set := readTestDomains(t, domains...)
+	if _, _, err := ApplyWhitelist(context.Background(), set, whitelist, 4, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(set.byTLD["example.com"]); got < serialThreshold {
+		t.Fatalf("got %d domains below “example.com”, too few for the worker pool", got)
+	}
+	minimal, err := Minimize(context.Background(), set, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(minimal)
+	var remaining []string
+	for _, domain := range domains {
+		if domain != "h10.example.com" && !strings.HasSuffix(domain, ".h10.example.com") {
+			remaining = append(remaining, domain)
+		}
+	}
+	if want := Minimal(remaining); !slices.Equal(minimal, want) {
+		t.Errorf("got %d minimal domains, want %d", len(minimal), len(want))
+	}
+	for _, domain := range minimal {
+		for parent := domain; strings.Contains(parent, "."); {
+			parent = parent[strings.IndexByte(parent, '.')+1:]
+			if _, found := slices.BinarySearch(minimal, parent); found {
+				t.Errorf("got %v together with its parent %v", domain, parent)
+			}
+		}
+	}
+}
+
+func TestMinimal(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		domains, want []string
+	}{
+		{"empty", nil, []string{}},
+		{"single", []string{"example.com"}, []string{"example.com"}},
+		{"nested", []string{"a.b.example.com", "example.com", "b.example.com"}, []string{"example.com"}},
+		{"siblings", []string{"b.example.com", "a.example.com", "x.a.example.com"},
+			[]string{"a.example.com", "b.example.com"}},
+		{"duplicates", []string{"a.example.com", "a.example.com", "x.a.example.com"}, []string{"a.example.com"}},
+		{"label boundary", []string{"ample.com", "example.com"}, []string{"ample.com", "example.com"}},
+		{"label boundary subdomain", []string{"ample.com", "x.example.com"}, []string{"ample.com", "x.example.com"}},
+		{"TLDs", []string{"example.org", "a.example.com", "b.example.org"}, []string{"a.example.com", "example.org"}},
+	} {
+		input := slices.Clone(test.domains)
+		got := Minimal(test.domains)
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%v: got %q, want %q", test.name, got, test.want)
+		}
+		if !slices.Equal(test.domains, input) {
+			t.Errorf("%v: input was changed to %q", test.name, test.domains)
+		}
+	}
+}
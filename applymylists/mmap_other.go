@@ -0,0 +1,19 @@
+//go:build !unix
+
+package applymylists
+
+import (
+	"errors"
+	"os"
+)
+
+// mapFile always fails because this platform does not support mapping files
+// into memory.
+func mapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("Memory mapping is not supported on this platform")
+}
+
+// unmapFile does nothing.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package applymylists
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file “f” read-only into memory and returns its contents.
+// It fails for anything but non-empty regular files.  The result must be
+// released with unmapFile.
+func mapFile(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("Not a regular file")
+	}
+	size := int(info.Size())
+	if size == 0 || int64(size) != info.Size() {
+		return nil, errors.New("Unsuitable file size")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile releases the memory returned by mapFile.
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
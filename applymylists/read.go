@@ -0,0 +1,583 @@
+package applymylists
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	tbr_logging "gitlab.com/bronger/tools/logging"
+)
+
+// ReadOptions controls how ReadDomains and ReadList treat their input.
+type ReadOptions struct {
+	// Strict makes invalid domain names a ParseError.  Otherwise, they are
+	// skipped with a warning.
+	Strict bool
+	// Format is the format of the large blacklist.  It is only used by
+	// ReadDomains.  FormatAuto means that the format is guessed.
+	Format InputFormat
+	// Workers is the number of goroutines parsing the large blacklist in
+	// ReadDomains.  If it is less than 1, the number of CPUs is used.
+	Workers int
+	// MaxDomains is the maximal number of domains ReadDomains accepts before
+	// it aborts with ErrTooManyDomains.  If it is 0, there is no limit.
+	MaxDomains int
+	// DomainCount, if not nil, is the number of domains read so far, which
+	// ReadDomains increases and checks against MaxDomains.  Sharing it between
+	// several calls makes MaxDomains a limit for all of their inputs
+	// together, e.g. for large blacklists which are merged afterwards.
+	DomainCount *atomic.Int64
+	// MaxDomainLength is the maximal length of the domains, in their ASCII
+	// form, ReadDomains keeps.  Longer domains, e.g. randomly generated ones,
+	// are dropped.  If it is 0, there is no limit.
+	MaxDomainLength int
+	// MaxSubdomainDepth is the maximal number of labels the domains
+	// ReadDomains keeps may have in front of their registrable domain, see
+	// subdomainDepth.  Deeper domains are dropped.  If it is 0, there is no
+	// limit.
+	MaxSubdomainDepth int
+	// Since drops domains from the large blacklist which were added before
+	// it, according to a date in their trailing comment, see lineDate.
+	// Domains without such a date are kept.  It is only used by ReadDomains
+	// for the hosts and the plain format.  If it is the zero time, nothing is
+	// dropped.
+	Since time.Time
+	// HostRegexp replaces the regular expression for the lines of the hosts
+	// format, e.g. for hosts files with another sink address.  It must have
+	// exactly one group, which captures the domain.  Lines not matching it
+	// are skipped with a warning.  If it is nil, the common IPv4 and IPv6
+	// sink addresses are accepted.  It is only used by ReadDomains.
+	HostRegexp *regexp.Regexp
+	// Source is the name of the large blacklist, e.g. its path.  If it is not
+	// empty, ReadDomains tracks for every domain the lists it was found in,
+	// see Domains.Sources.  This costs quite some memory.
+	Source string
+	// ExcludedTLDs lists domains, e.g. “gov” or “co.uk”, which are dropped
+	// from the large blacklist together with all of their subdomains.  They
+	// are not added by ApplyBlacklist either.  This is only used by
+	// ReadDomains.
+	ExcludedTLDs []string
+	// OnlyTLDs lists domains, e.g. “com” or “example.org”, to which the large
+	// blacklist is restricted; all other domains are dropped, and not added
+	// by ApplyBlacklist either.  If it is empty, nothing is dropped.  This is
+	// only used by ReadDomains.
+	OnlyTLDs []string
+	// Mmap makes ReadDomains map its input into memory instead of reading
+	// it, if the input is a regular file and the platform supports this.
+	// Otherwise, the input is read as usual.  This saves copying the lines.
+	Mmap bool
+}
+
+// ErrTooManyDomains is returned by ReadDomains if the input contains more
+// domains than allowed by “ReadOptions.MaxDomains”.
+var ErrTooManyDomains = errors.New("Too many domains")
+
+// ParseError is returned by ReadDomains, ReadList, and ReadPatterns for a line
+// which cannot be used, e.g. an invalid domain name with “ReadOptions.Strict”.
+type ParseError struct {
+	// File is the path of the file containing the line.  These functions
+	// read from an io.Reader, so they leave it empty; callers knowing the
+	// path may set it, see ListError.  It is not part of the message.
+	File string
+	// Line is the number of the line, starting with 1.
+	Line int
+	// Content is the complete line.
+	Content string
+	// Err is the reason why the line is invalid.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Invalid line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ListError is an error in the list file at Path, e.g. a ParseError.  The
+// functions of this package never return it, because they do not know the
+// path of what they read; it is meant for callers reading files, which wrap
+// the errors of these functions in it.
+type ListError struct {
+	// Path is the path or URL of the file.
+	Path string
+	// Err is the error in the file.
+	Err error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("Error in file “%v”: %v", e.Path, e.Err)
+}
+
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+// Check returns an error if the options are invalid, e.g. because an excluded
+// TLD is not a valid domain name.  ReadDomains does this check, too, but
+// calling it early gives more helpful error messages.
+func (options ReadOptions) Check() error {
+	if options.MaxDomainLength < 0 {
+		return fmt.Errorf("Invalid maximal domain length %d", options.MaxDomainLength)
+	}
+	if options.MaxSubdomainDepth < 0 {
+		return fmt.Errorf("Invalid maximal subdomain depth %d", options.MaxSubdomainDepth)
+	}
+	if _, err := normalizeTLDs(options.ExcludedTLDs); err != nil {
+		return fmt.Errorf("Invalid excluded TLD: %w", err)
+	}
+	if _, err := normalizeTLDs(options.OnlyTLDs); err != nil {
+		return fmt.Errorf("Invalid only TLD: %w", err)
+	}
+	return checkHostRegexp(options.HostRegexp)
+}
+
+// normalizeTLDs returns the normalised forms of “tlds”, as given in
+// ReadOptions, with the leading “.”.
+func normalizeTLDs(tlds []string) (normalized []string, err error) {
+	for _, tld := range tlds {
+		tld, err := NormalizeDomain(strings.TrimPrefix(tld, "."))
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, "."+tld)
+	}
+	return
+}
+
+// sniffSize is the number of bytes at the beginning of the large blacklist
+// which are used to detect its format.
+const sniffSize = 64 << 10
+
+// batchSize is the number of lines ReadDomains passes to a parser at once.
+const batchSize = 1024
+
+// lineBatch is a chunk of consecutive lines of the large blacklist.
+type lineBatch struct {
+	firstLineNumber int
+	lines           []string
+}
+
+// parsedDomain is a domain found by parseBatch.  “domain” has the leading “.”
+// unless “exception” is true, and “tld” is empty for exceptions.
+type parsedDomain struct {
+	domain, tld string
+	exception   bool
+}
+
+// parsedBatch is the result of parseBatch for one lineBatch.
+type parsedBatch struct {
+	domains                                                                       []parsedDomain
+	numberCosmetic, numberUnsupported, numberTooLong, numberTooDeep, numberTooOld int
+	err                                                                           error
+}
+
+// parseBatch does the parallelisable work of ReadDomains: parsing the lines,
+// normalising and checking the domains, and determining their TLDs.  Only
+// errors which abort the reading end up in “err” of the result, everything
+// else is logged.
+func parseBatch(batch lineBatch, domains *Domains, options ReadOptions, logger tbr_logging.Logger) (result parsedBatch) {
+	parseLine := parseHostsLine
+	if options.HostRegexp != nil {
+		parseLine = func(line string) (string, bool, error) {
+			return parseHostsLineWith(options.HostRegexp, line)
+		}
+	}
+	switch options.Format {
+	case FormatABP:
+		parseLine = parseABPLine
+	case FormatPlain:
+		parseLine = parsePlainLine
+	}
+	// retain returns “s”, copied if it points into mapped input.  Everything
+	// passed on to the logger or put into an error must be retained because
+	// they may keep it after the input was unmapped.
+	retain := func(s string) string {
+		if options.Mmap {
+			return strings.Clone(s)
+		}
+		return s
+	}
+	for i, line := range batch.lines {
+		lineNumber := batch.firstLineNumber + i
+		trimmedLine := strings.TrimSpace(line)
+		if trimmedLine == "" || options.Format != FormatABP && strings.HasPrefix(trimmedLine, "#") {
+			continue
+		}
+		domain, exception, err := parseLine(line)
+		switch {
+		case errors.Is(err, errCosmeticRule):
+			logger.Debug("Ignoring cosmetic rule in domains file", "line", lineNumber, "content", retain(line))
+			result.numberCosmetic++
+			continue
+		case errors.Is(err, errUnsupportedRule):
+			logger.Debug("Ignoring unsupported rule in domains file", "line", lineNumber, "content", retain(line))
+			result.numberUnsupported++
+			continue
+		case err != nil:
+			logger.Warn("Skipping invalid line in domains file", "line", lineNumber, "content", retain(line))
+			continue
+		case domain == "":
+			continue
+		}
+		domain, err = NormalizeDomain(domain)
+		if err != nil {
+			if options.Strict {
+				result.err = &ParseError{Line: lineNumber, Content: retain(line), Err: err}
+				return
+			}
+			logger.Warn("Skipping invalid domain in domains file", "line", lineNumber, "content", retain(line),
+				"error", err)
+			continue
+		}
+		if exception {
+			result.domains = append(result.domains, parsedDomain{domain: domain, exception: true})
+			continue
+		}
+		if !options.Since.IsZero() && options.Format != FormatABP {
+			if date, ok := lineDate(line); ok && date.Before(options.Since) {
+				logger.Debug("Skipping domain added before cutoff", "line", lineNumber, "domain", retain(domain))
+				result.numberTooOld++
+				continue
+			}
+		}
+		if options.MaxDomainLength > 0 && len(domain) > options.MaxDomainLength {
+			logger.Debug("Skipping too long domain", "line", lineNumber, "domain", retain(domain))
+			result.numberTooLong++
+			continue
+		}
+		domain = "." + domain
+		if domains.isExcluded(domain) {
+			logger.Debug("Skipping domain with excluded TLD", "line", lineNumber, "domain", domain[1:])
+			continue
+		}
+		tld, err := getTLD(domain)
+		if err != nil {
+			logger.Warn("Skipping domain in domains file", "line", lineNumber, "error", err)
+			continue
+		}
+		if options.MaxSubdomainDepth > 0 && subdomainDepth(domain, tld) > options.MaxSubdomainDepth {
+			logger.Debug("Skipping too deep domain", "line", lineNumber, "domain", domain[1:])
+			result.numberTooDeep++
+			continue
+		}
+		result.domains = append(result.domains, parsedDomain{domain: domain, tld: tld})
+	}
+	return
+}
+
+// ReadDomains reads the large blacklist from “r” and returns its domains.  See
+// README.rst for the formats.  Empty lines and comment lines are ignored, other
+// lines that are not understood are skipped with a warning.  The same is true
+// for invalid domain names, unless “options.Strict” is true, in which case they
+// lead to a ParseError.  Domains below “options.ExcludedTLDs”, or not below any
+// of “options.OnlyTLDs”, are skipped, as are domains longer than
+// “options.MaxDomainLength” or deeper than “options.MaxSubdomainDepth”, or
+// added before “options.Since”.
+// Reading is aborted if “ctx” is cancelled, or with ErrTooManyDomains if there
+// are more than “options.MaxDomains” domains, counting those in
+// “options.DomainCount” from earlier calls.
+//
+// If “options.Format” is FormatAuto, the format is guessed from the beginning
+// of the input, see detectFormat.
+//
+// Some formats can also contain exceptions from blacklisting.  They are
+// returned in “exceptions” and should be applied with ApplyWhitelist.
+//
+// If “options.Mmap” is true and “r” is an *os.File, the file is mapped into
+// memory, and the lines are sliced out of it without copying.
+//
+// The input is read in batches of lines by one goroutine, and the batches are
+// parsed by “options.Workers” goroutines.  Only the calling goroutine
+// modifies the result, so no locking is needed for it.  As a consequence,
+// messages about single lines are not logged in the order of the lines.
+func ReadDomains(ctx context.Context, r io.Reader, options ReadOptions, logger tbr_logging.Logger) (
+	domains *Domains, exceptions []string, err error) {
+	domains = NewDomains()
+	if options.Source != "" {
+		domains.sources = make(map[string][]string)
+	}
+	if domains.excludedTLDs, err = normalizeTLDs(options.ExcludedTLDs); err != nil {
+		return nil, nil, fmt.Errorf("Invalid excluded TLD: %w", err)
+	}
+	if domains.onlyTLDs, err = normalizeTLDs(options.OnlyTLDs); err != nil {
+		return nil, nil, fmt.Errorf("Invalid only TLD: %w", err)
+	}
+	if err = checkHostRegexp(options.HostRegexp); err != nil {
+		return nil, nil, err
+	}
+	var data []byte
+	if f, ok := r.(*os.File); ok && options.Mmap {
+		if data, err = mapFile(f); err != nil {
+			logger.Info("Could not map input into memory; reading it instead", "error", err)
+			data, err = nil, nil
+		} else {
+			defer unmapFile(data)
+		}
+	}
+	// From here on, “options.Mmap” tells whether the lines point into mapped
+	// input, see parseBatch.
+	options.Mmap = data != nil
+	if options.Format == FormatAuto && data != nil {
+		sample := data
+		if len(sample) > sniffSize {
+			sample = sample[:sniffSize]
+		}
+		options.Format = detectFormat(sample)
+		logger.Info("Detected input format", "format", options.Format)
+	} else if options.Format == FormatAuto {
+		bufferedReader := bufio.NewReaderSize(r, sniffSize)
+		// An error here means that the input is shorter than sniffSize, or
+		// that reading fails, which is reported below anyway.
+		sample, _ := bufferedReader.Peek(sniffSize)
+		options.Format = detectFormat(sample)
+		logger.Info("Detected input format", "format", options.Format)
+		r = bufferedReader
+	}
+	workers := options.Workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	parseCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	batches := make(chan lineBatch, workers)
+	var scanErr error
+	go func() {
+		defer close(batches)
+		if data != nil {
+			splitMapped(parseCtx, data, batches)
+		} else {
+			scanErr = scanLines(parseCtx, r, batches)
+		}
+	}()
+	results := make(chan parsedBatch, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if parseCtx.Err() != nil {
+					continue
+				}
+				results <- parseBatch(batch, domains, options, logger)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	domainCount := options.DomainCount
+	if domainCount == nil {
+		domainCount = new(atomic.Int64)
+	}
+	var numberDomains, numberCosmetic, numberUnsupported, numberTooLong, numberTooDeep, numberTooOld int
+	for result := range results {
+		if err == nil {
+			err = result.err
+		}
+		if err != nil {
+			cancel()
+			continue
+		}
+		numberCosmetic += result.numberCosmetic
+		numberUnsupported += result.numberUnsupported
+		numberTooLong += result.numberTooLong
+		numberTooDeep += result.numberTooDeep
+		numberTooOld += result.numberTooOld
+		var numberBatchDomains int
+		for _, parsed := range result.domains {
+			if parsed.exception {
+				// The domain may still point into the mapped input.
+				exceptions = append(exceptions, strings.Clone(parsed.domain))
+			} else {
+				domains.insert(parsed.tld, parsed.domain)
+				domains.addSource(parsed.domain, options.Source)
+				numberBatchDomains++
+			}
+		}
+		numberDomains += numberBatchDomains
+		total := domainCount.Add(int64(numberBatchDomains))
+		if options.MaxDomains > 0 && total > int64(options.MaxDomains) {
+			err = fmt.Errorf("%w: more than %d", ErrTooManyDomains, options.MaxDomains)
+			cancel()
+		}
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, nil, ctxErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if scanErr != nil {
+		return nil, nil, scanErr
+	}
+	if numberCosmetic > 0 {
+		logger.Warn("Ignored cosmetic rules in domains file", "number", numberCosmetic)
+	}
+	if numberUnsupported > 0 {
+		logger.Warn("Ignored unsupported rules in domains file", "number", numberUnsupported)
+	}
+	if numberTooLong > 0 {
+		logger.Warn("Skipped too long domains in domains file", "number", numberTooLong,
+			"maxLength", options.MaxDomainLength)
+	}
+	if numberTooDeep > 0 {
+		logger.Warn("Skipped too deep domains in domains file", "number", numberTooDeep,
+			"maxDepth", options.MaxSubdomainDepth)
+	}
+	if numberTooOld > 0 {
+		logger.Info("Skipped domains added before cutoff in domains file", "number", numberTooOld,
+			"since", options.Since.Format(dateLayout))
+	}
+	logger.Info("Finished reading domains", "number", numberDomains, "numberTLDs", domains.NumberTLDs(),
+		"numberExceptions", len(exceptions))
+	return
+}
+
+// batchLines collects the lines returned by “next” into batches and sends them
+// to “batches”.  It stops if “next” returns false or if “ctx” is cancelled.  It
+// returns the number of lines it got from “next”.
+func batchLines(ctx context.Context, next func() (line string, ok bool), batches chan<- lineBatch) (
+	lineNumber int) {
+	batch := lineBatch{firstLineNumber: 1}
+	for line, ok := next(); ok; line, ok = next() {
+		lineNumber++
+		batch.lines = append(batch.lines, line)
+		if len(batch.lines) == batchSize {
+			select {
+			case batches <- batch:
+			case <-ctx.Done():
+				return
+			}
+			batch = lineBatch{firstLineNumber: lineNumber + 1}
+		}
+	}
+	if len(batch.lines) > 0 {
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+		}
+	}
+	return
+}
+
+// scanLines reads the lines from “r” and sends them in batches to “batches”,
+// see batchLines.  A read error contains the number of the last line read
+// successfully.
+func scanLines(ctx context.Context, r io.Reader, batches chan<- lineBatch) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	lineNumber := batchLines(ctx, func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		return scanner.Text(), true
+	}, batches)
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Read error after line %d: %w", lineNumber, err)
+	}
+	return nil
+}
+
+// splitMapped is like scanLines, but for input mapped into memory.  Like
+// bufio.ScanLines, it strips trailing carriage returns.  The lines are not
+// copied but point into “data”, so the caller must keep “data” mapped as long
+// as the lines or substrings of them are in use.
+func splitMapped(ctx context.Context, data []byte, batches chan<- lineBatch) {
+	batchLines(ctx, func() (string, bool) {
+		if len(data) == 0 {
+			return "", false
+		}
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return *(*string)(unsafe.Pointer(&line)), true
+	}, batches)
+}
+
+// ReadList reads a personal black or whitelist from “r” and returns its
+// normalised domain names.  See README.rst for the format.  Comments start with
+// “#” and may also follow a domain on the same line.  Invalid domain names are
+// skipped with a warning, or, if “options.Strict” is true, lead to a
+// ParseError.  A domain may be prefixed with “*.” or “-”, which is kept in the
+// result; see ApplyWhitelist and ApplyBlacklist, respectively, for their
+// meanings.
+func ReadList(r io.Reader, options ReadOptions, logger tbr_logging.Logger) (entries []string, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		line, removal := strings.CutPrefix(line, "-")
+		line, wildcard := strings.CutPrefix(line, "*.")
+		domain, err := NormalizeDomain(line)
+		if err != nil {
+			if options.Strict {
+				return nil, &ParseError{Line: lineNumber, Content: scanner.Text(), Err: err}
+			}
+			logger.Warn("Skipping invalid domain in list file", "line", lineNumber, "content", scanner.Text(), "error", err)
+			continue
+		}
+		if wildcard {
+			domain = "*." + domain
+		}
+		if removal {
+			domain = "-" + domain
+		}
+		entries = append(entries, domain)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Read error after line %d: %w", lineNumber, err)
+	}
+	return
+}
+
+// ReadPatterns reads regular expressions, one per line, from “r”, e.g. for
+// SetKeepPatterns.  Empty lines and lines starting with “#” are ignored.  The
+// patterns use the syntax of the “regexp” package; anchors must be given
+// explicitly.  Invalid patterns lead to a ParseError.
+func ReadPatterns(r io.Reader) (patterns []*regexp.Regexp, err error) {
+	scanner := bufio.NewScanner(r)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := regexp.Compile(line)
+		if err != nil {
+			return nil, &ParseError{Line: lineNumber, Content: scanner.Text(), Err: err}
+		}
+		patterns = append(patterns, pattern)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Read error after line %d: %w", lineNumber, err)
+	}
+	return
+}
@@ -0,0 +1,400 @@
+package applymylists
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadDomainsMalformedLines(t *testing.T) {
+	input := "# comment\n\n127.0.0.1 evil.test.com\nnonsense\n0.0.0.0\n0.0.0.0 ads.example.com\n"
+	logger := new(testLogger)
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.com", "evil.test.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := len(logger.warnings); got != 2 {
+		t.Errorf("got %d warnings, want 2 for the malformed lines: %q", got, logger.warnings)
+	}
+}
+
+func TestReadDomainsCaseDuplicates(t *testing.T) {
+	input := "0.0.0.0 Evil.test.com\n127.0.0.1 evil.test.com\n0.0.0.0 EVIL.TEST.COM\n"
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"evil.test.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadTrailingDot(t *testing.T) {
+	input := "0.0.0.0 evil.example.com.\n0.0.0.0 evil.example.com\n0.0.0.0 ads.example.org.\n"
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.org", "evil.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("got domains %q, want %q", got, want)
+	}
+	entries, err := ReadList(strings.NewReader("evil.example.com.\nads.example.org\n"), ReadOptions{Strict: true},
+		discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"evil.example.com", "ads.example.org"}; !slices.Equal(entries, want) {
+		t.Errorf("got entries %q, want %q", entries, want)
+	}
+	for _, domain := range []string{"evil.example.com.", "EVIL.example.com"} {
+		if normalized, err := NormalizeDomain(domain); err != nil || normalized != "evil.example.com" {
+			t.Errorf("NormalizeDomain(%q) = %q, %v, want %q", domain, normalized, err, "evil.example.com")
+		}
+	}
+}
+
+func TestReadListStrict(t *testing.T) {
+	input := "good.example.com\nexa mple.com\n"
+	entries, err := ReadList(strings.NewReader(input), ReadOptions{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0] != "good.example.com" {
+		t.Errorf("got %q, want only the valid entry", entries)
+	}
+	if _, err := ReadList(strings.NewReader(input), ReadOptions{Strict: true}, discardLogger); err == nil {
+		t.Error("invalid entry did not fail in strict mode")
+	}
+}
+
+func BenchmarkReadDomains(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		input := hostsFile(generateDomains(n))
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{},
+					discardLogger)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDomainsABP(t *testing.T) {
+	input := "[Adblock Plus 2.0]\n! Title: Test\n||doubleclick.net^\n||ads.example.com^\n@@||good.example.org^\n" +
+		"example.com##.ad-banner\n"
+	logger := new(testLogger)
+	domains, exceptions, err := ReadDomains(context.Background(), strings.NewReader(input),
+		ReadOptions{Format: FormatABP}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.com", "doubleclick.net"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := []string{"good.example.org"}; !slices.Equal(exceptions, want) {
+		t.Errorf("got exceptions %q, want %q", exceptions, want)
+	}
+	if !logger.warned("Ignored cosmetic rules") {
+		t.Errorf("cosmetic rule was not warned about: %q", logger.warnings)
+	}
+}
+
+func TestReadDomainsIPv6(t *testing.T) {
+	input := "0.0.0.0 evil.test.com\n:: evil.test.com\n::1 ads.test.com\n127.0.0.1 ads.test.com\n:: only6.test.com\n"
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"ads.test.com", "evil.test.com", "only6.test.com"}
+	if got := sortedAll(domains); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadListComments(t *testing.T) {
+	input := "# full-line comment\nevil.example.com  # added 2024, phishing\n#\n  ads.example.org\t\n" +
+		"tracker.example.net#no space\n"
+	entries, err := ReadList(strings.NewReader(input), ReadOptions{Strict: true}, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"evil.example.com", "ads.example.org", "tracker.example.net"}; !slices.Equal(entries, want) {
+		t.Errorf("got %q, want %q", entries, want)
+	}
+}
+
+// BenchmarkReadDomainsWorkers measures the speedup of the concurrent parsing
+// on a hosts file with 1,000,000 lines.
+func BenchmarkReadDomainsWorkers(b *testing.B) {
+	input := hostsFile(generateDomains(1000000))
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(strconv.Itoa(workers), func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{Workers: workers},
+					discardLogger)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadDomainsMaxDomains(t *testing.T) {
+	input := hostsFile([]string{"a.example.com", "b.example.com", "c.example.com"})
+	_, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{MaxDomains: 2},
+		discardLogger)
+	if !errors.Is(err, ErrTooManyDomains) {
+		t.Errorf("got error %v, want %v", err, ErrTooManyDomains)
+	}
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{MaxDomains: 3},
+		discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domains.Len(); got != 3 {
+		t.Errorf("got %d domains, want 3", got)
+	}
+}
+
+func TestReadDomainsDomainCount(t *testing.T) {
+	options := ReadOptions{MaxDomains: 3, DomainCount: new(atomic.Int64)}
+	first := hostsFile([]string{"a.example.com", "b.example.com"})
+	if _, _, err := ReadDomains(context.Background(), strings.NewReader(first), options, discardLogger); err != nil {
+		t.Fatal(err)
+	}
+	second := hostsFile([]string{"c.example.com", "d.example.com"})
+	_, _, err := ReadDomains(context.Background(), strings.NewReader(second), options, discardLogger)
+	if !errors.Is(err, ErrTooManyDomains) {
+		t.Errorf("got error %v, want %v", err, ErrTooManyDomains)
+	}
+}
+
+func TestReadDomainsNoTLD(t *testing.T) {
+	logger := new(testLogger)
+	domains, _, err := ReadDomains(context.Background(),
+		strings.NewReader("0.0.0.0 localhost\n0.0.0.0 co.uk\n0.0.0.0 ads.example.com\n"), ReadOptions{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !logger.warned("Skipping domain") {
+		t.Errorf("got warnings %q, want ones for the domains without TLD", logger.warnings)
+	}
+}
+
+func TestReadDomainsMaxDomainLength(t *testing.T) {
+	// The domains are 14, 15, and 16 characters long.
+	input := hostsFile([]string{"ab.example.com", "abc.example.com", "abcd.example.com"})
+	logger := new(testLogger)
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{MaxDomainLength: 15},
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ab.example.com", "abc.example.com"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !logger.warned("Skipped too long domains") {
+		t.Errorf("got warnings %q, want one about the dropped domain", logger.warnings)
+	}
+}
+
+func TestReadDomainsMaxSubdomainDepth(t *testing.T) {
+	input := hostsFile([]string{"example.com", "a.example.com", "a.b.example.com", "a.b.c.example.com"})
+	logger := new(testLogger)
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{MaxSubdomainDepth: 2},
+		logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.b.example.com", "a.example.com", "example.com"}
+	if got := sortedAll(domains); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !logger.warned("Skipped too deep domains") {
+		t.Errorf("got warnings %q, want one about the dropped domain", logger.warnings)
+	}
+}
+
+// TestReadDomainsMaxSubdomainDepthTLDs checks that the depth counts from the
+// registrable domain also below public suffixes with several labels, and that
+// private suffixes like “github.io” count as registrable domains.
+func TestReadDomainsMaxSubdomainDepthTLDs(t *testing.T) {
+	input := hostsFile([]string{"b.example.co.uk", "a.b.example.co.uk", "x.a.b.example.co.uk",
+		"user.github.io", "b.user.github.io", "a.b.user.github.io", "a.b.example.com", "x.a.b.example.com"})
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{MaxSubdomainDepth: 2},
+		discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.b.example.co.uk", "a.b.example.com", "b.example.co.uk", "b.user.github.io",
+		"user.github.io"}
+	if got := sortedAll(domains); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadDomainsSince(t *testing.T) {
+	input := "0.0.0.0 old.example.com # 2024-05-31\n0.0.0.0 cutoff.example.com # 2024-06-01\n" +
+		"0.0.0.0 new.example.com # 2024-06-02 phishing\n0.0.0.0 undated.example.com\n" +
+		"0.0.0.0 commented.example.com # phishing\n"
+	for _, test := range []struct {
+		format InputFormat
+		input  string
+	}{
+		{FormatHosts, input},
+		{FormatPlain, strings.ReplaceAll(input, "0.0.0.0 ", "")},
+	} {
+		options := ReadOptions{Format: test.format, Since: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}
+		domains, _, err := ReadDomains(context.Background(), strings.NewReader(test.input), options, discardLogger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"commented.example.com", "cutoff.example.com", "new.example.com", "undated.example.com"}
+		if got := sortedAll(domains); !slices.Equal(got, want) {
+			t.Errorf("format %v: got %q, want %q", test.format, got, want)
+		}
+	}
+}
+
+func TestReadDomainsHostRegexp(t *testing.T) {
+	input := "# custom sink\n10.0.0.1\tads.example.com\n10.0.0.1\t\tevil.example.org  # phishing\n" +
+		"0.0.0.0 other.example.net\n"
+	options := ReadOptions{HostRegexp: regexp.MustCompile(`^10\.0\.0\.1\t+([^\s#]+)\s*(?:#.*)?$`)}
+	logger := new(testLogger)
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), options, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.com", "evil.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(logger.warnings) != 1 {
+		t.Errorf("got warnings %q, want one for the line with the default sink", logger.warnings)
+	}
+	for _, expr := range []string{`^10\.0\.0\.1\t+\S+$`, `^(10\.0\.0\.1)\t+(\S+)$`} {
+		options := ReadOptions{HostRegexp: regexp.MustCompile(expr)}
+		if err := options.Check(); err == nil {
+			t.Errorf("host regexp %q did not fail the check", expr)
+		}
+		_, _, err := ReadDomains(context.Background(), strings.NewReader(input), options, discardLogger)
+		if err == nil {
+			t.Errorf("ReadDomains with host regexp %q did not fail", expr)
+		}
+	}
+}
+
+func TestReadDomainsFormatOverride(t *testing.T) {
+	// The “!” lines make this plain list look like an ABP filter list.
+	input := "!a\n!b\n!c\nads.example.com\nevil.example.org\n"
+	domains, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{Format: FormatAuto},
+		discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domains.Len(); got != 0 {
+		t.Errorf("got %d domains, want none for the misdetected format", got)
+	}
+	domains, _, err = ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{Format: FormatPlain},
+		discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedAll(domains), []string{"ads.example.com", "evil.example.org"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// writeTempFile writes “content” to a temporary file and returns it opened.
+func writeTempFile(tb testing.TB, content string) *os.File {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), "hosts")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Close() })
+	return f
+}
+
+// TestReadDomainsMmapParseError checks that the ParseError does not point into
+// the mapped input, which is unmapped when ReadDomains returns.
+func TestReadDomainsMmapParseError(t *testing.T) {
+	f := writeTempFile(t, "0.0.0.0 ads.example.com\n0.0.0.0 exa_mple..com\n")
+	_, _, err := ReadDomains(context.Background(), f, ReadOptions{Strict: true, Mmap: true}, discardLogger)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("got error %v, want a ParseError", err)
+	}
+	if parseErr.Line != 2 || parseErr.Content != "0.0.0.0 exa_mple..com" {
+		t.Errorf("got line %d, %q, want the second one", parseErr.Line, parseErr.Content)
+	}
+}
+
+// BenchmarkReadDomainsMmap compares reading a file of 100,000 domains with
+// mapping it into memory.
+func BenchmarkReadDomainsMmap(b *testing.B) {
+	input := hostsFile(generateDomains(100000))
+	f := writeTempFile(b, input)
+	for _, mmap := range []bool{false, true} {
+		name := "read"
+		if mmap {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				_, _, err := ReadDomains(context.Background(), f, ReadOptions{Mmap: mmap}, discardLogger)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrorLineNumber(t *testing.T) {
+	input := "# header\n0.0.0.0 ads.example.com\n\n0.0.0.0 exa_mple..com\n0.0.0.0 evil.example.org\n"
+	_, _, err := ReadDomains(context.Background(), strings.NewReader(input), ReadOptions{Strict: true}, discardLogger)
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) || parseErr.Line != 4 || parseErr.Content != "0.0.0.0 exa_mple..com" {
+		t.Fatalf("got error %v, want a ParseError for line 4", err)
+	}
+	if !strings.HasPrefix(err.Error(), "Invalid line 4: ") {
+		t.Errorf("got message %q without the line number", err)
+	}
+	_, err = ReadList(strings.NewReader("ads.example.com\n# comment\nexa mple.com\n"), ReadOptions{Strict: true},
+		discardLogger)
+	if !errors.As(err, &parseErr) || parseErr.Line != 3 || parseErr.Content != "exa mple.com" {
+		t.Errorf("got error %v, want a ParseError for line 3", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFile is the content of a configuration file in TOML format.  Its keys
+// are the names of the flags without the leading “-”, and aliases are allowed,
+// see flagAliases.  Options which may be given multiple times are arrays.
+// Durations are strings like “5m”.  There is no key for “-config” itself.
+type configFile struct {
+	Input             []string      `toml:"input"`
+	Blacklist         []string      `toml:"blacklist"`
+	Whitelist         []string      `toml:"whitelist"`
+	WhitelistExact    []string      `toml:"whitelist-exact"`
+	RegexKeep         string        `toml:"regex-keep"`
+	Output            string        `toml:"output"`
+	Workers           int           `toml:"workers"`
+	Append            bool          `toml:"append"`
+	Diff              string        `toml:"diff"`
+	WriteAttempts     int           `toml:"write-attempts"`
+	WriteRetryDelay   time.Duration `toml:"write-retry-delay"`
+	Checksum          bool          `toml:"checksum"`
+	SplitByTLD        bool          `toml:"split-by-tld"`
+	ValidateOutput    bool          `toml:"validate-output"`
+	WhitelistOutput   string        `toml:"whitelist-output"`
+	DryRun            bool          `toml:"dry-run"`
+	CountOnly         bool          `toml:"count-only"`
+	NormalizeOnly     bool          `toml:"normalize-only"`
+	ListTLDs          bool          `toml:"list-tlds"`
+	LintWhitelist     bool          `toml:"lint-whitelist"`
+	OutputFormat      string        `toml:"output-format"`
+	SortOutput        string        `toml:"sort-output"`
+	SinkAddress       string        `toml:"sink-address"`
+	WhitelistForward  string        `toml:"whitelist-forward"`
+	Template          string        `toml:"template"`
+	WhitelistTemplate string        `toml:"whitelist-template"`
+	StatsJSON         string        `toml:"stats-json"`
+	ExcludeTLD        []string      `toml:"exclude-tld"`
+	OnlyTLD           []string      `toml:"only-tld"`
+	IncludeTLD        []string      `toml:"include-tld"`
+	InputFormat       string        `toml:"input-format"`
+	Annotate          bool          `toml:"annotate"`
+	MaxDomains        int           `toml:"max-domains"`
+	MaxDomainLength   int           `toml:"max-domain-length"`
+	MaxSubdomainDepth int           `toml:"max-subdomain-depth"`
+	HostRegexp        string        `toml:"host-regexp"`
+	Since             string        `toml:"since"`
+	Mmap              bool          `toml:"mmap"`
+	Strict            bool          `toml:"strict"`
+	HTTPTimeout       time.Duration `toml:"http-timeout"`
+	CacheDir          string        `toml:"cache-dir"`
+	InputCacheDir     string        `toml:"input-cache-dir"`
+	Timeout           time.Duration `toml:"timeout"`
+	Verbose           bool          `toml:"verbose"`
+	V                 bool          `toml:"v"`
+	Quiet             bool          `toml:"quiet"`
+	Q                 bool          `toml:"q"`
+	ProgressInterval  time.Duration `toml:"progress-interval"`
+	LogFormat         string        `toml:"log-format"`
+	LogFile           string        `toml:"log-file"`
+	CPUProfile        string        `toml:"cpuprofile"`
+	MemProfile        string        `toml:"memprofile"`
+	ReportResources   bool          `toml:"report-resources"`
+}
+
+// loadConfigFile sets the flags of “flags” from the configuration file at
+// “path”, see configFile.  Only the keys present in the file are set.  An
+// option must not be given twice, not even under an alias and its canonical
+// name.
+//
+// Flags which were already set on the command line, under any of their names,
+// are left alone, so the command line takes precedence over the file.
+// Therefore, this must be called after “flags” was parsed.
+func loadConfigFile(path string, flags *flag.FlagSet) error {
+	var file configFile
+	metadata, err := toml.DecodeFile(path, &file)
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file “%v”: %w", path, err)
+	}
+	if undecoded := metadata.Undecoded(); len(undecoded) > 0 {
+		return fmt.Errorf("Unknown option “%v” in configuration file “%v”", undecoded[0], path)
+	}
+	setOnCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[canonicalFlagName(f.Name)] = true
+	})
+	setInFile := make(map[string]string)
+	fileValue := reflect.ValueOf(file)
+	for i := 0; i < fileValue.NumField(); i++ {
+		name := fileValue.Type().Field(i).Tag.Get("toml")
+		if !metadata.IsDefined(name) {
+			continue
+		}
+		canonical := canonicalFlagName(name)
+		if other, ok := setInFile[canonical]; ok {
+			return fmt.Errorf("Option “%v” is given twice in configuration file “%v”, also as “%v”", name, path,
+				other)
+		}
+		setInFile[canonical] = name
+		if setOnCommandLine[canonical] {
+			continue
+		}
+		values, ok := fileValue.Field(i).Interface().([]string)
+		if !ok {
+			values = []string{fmt.Sprint(fileValue.Field(i).Interface())}
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return fmt.Errorf("Invalid value for “%v” in configuration file “%v”: %w", name, path, err)
+			}
+		}
+	}
+	return nil
+}
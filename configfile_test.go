@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "config", `# comment
+workers = 4
+output = "/etc/servers blacklist"
+blacklist = ["a.list", "b.list"]
+http-timeout = "2m"
+strict = true
+`)
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	workers := flags.Int("workers", 1, "")
+	output := flags.String("output", "", "")
+	blacklists := stringList{values: []string{"/tmp/my_blacklist"}}
+	flags.Var(&blacklists, "blacklist", "")
+	httpTimeout := flags.Duration("http-timeout", time.Minute, "")
+	strict := flags.Bool("strict", false, "")
+	if err := flags.Parse([]string{"-workers", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(path, flags); err != nil {
+		t.Fatal(err)
+	}
+	if *workers != 8 {
+		t.Errorf("got %d workers, want 8 from the command line", *workers)
+	}
+	if *output != "/etc/servers blacklist" {
+		t.Errorf("got output %q, want the value of the file", *output)
+	}
+	if want := []string{"a.list", "b.list"}; !slices.Equal(blacklists.values, want) {
+		t.Errorf("got blacklists %q, want %q replacing the default", blacklists.values, want)
+	}
+	if *httpTimeout != 2*time.Minute {
+		t.Errorf("got HTTP timeout %v, want 2m0s", *httpTimeout)
+	}
+	if !*strict {
+		t.Error("strict was not set")
+	}
+}
+
+// newAliasFlags returns a flag set with “-only-tld” and its alias
+// “-include-tld”, both writing to the returned list.
+func newAliasFlags() (*flag.FlagSet, *stringList) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	var onlyTLDs stringList
+	flags.Var(&onlyTLDs, "only-tld", "")
+	flags.Var(&onlyTLDs, "include-tld", "")
+	return flags, &onlyTLDs
+}
+
+func TestLoadConfigFileAlias(t *testing.T) {
+	dir := t.TempDir()
+	for _, test := range []struct {
+		name, content string
+		args          []string
+		want          []string
+	}{
+		{"alias in file", `include-tld = ["com"]`, nil, []string{"com"}},
+		{"canonical on command line", `include-tld = ["com"]`, []string{"-only-tld", "org"}, []string{"org"}},
+		{"alias on command line", `only-tld = ["com"]`, []string{"-include-tld", "org"}, []string{"org"}},
+	} {
+		flags, onlyTLDs := newAliasFlags()
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadConfigFile(writeTestFile(t, dir, "config", test.content), flags); err != nil {
+			t.Errorf("%v: %v", test.name, err)
+		} else if !slices.Equal(onlyTLDs.values, test.want) {
+			t.Errorf("%v: got %q, want %q", test.name, onlyTLDs.values, test.want)
+		}
+	}
+	flags, _ := newAliasFlags()
+	path := writeTestFile(t, dir, "config", "only-tld = [\"com\"]\ninclude-tld = [\"org\"]\n")
+	if err := loadConfigFile(path, flags); err == nil {
+		t.Error("option given under both names did not fail")
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{"workers\n", "unknown = 1\n", "config = \"other\"\n", "workers = \"many\"\n",
+		"output = \"unterminated\n", "blacklist = \"a.list\"\n", "workers = 1\nworkers = 2\n"} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		flags.Int("workers", 1, "")
+		flags.String("output", "", "")
+		flags.String("config", "", "")
+		flags.Var(new(stringList), "blacklist", "")
+		if err := loadConfigFile(writeTestFile(t, dir, "config", content), flags); err == nil {
+			t.Errorf("configuration %q did not fail", content)
+		}
+	}
+}
+
+// TestConfigFileAliases checks that every alias has a key in configFile, so
+// that it can be used in configuration files, too.
+func TestConfigFileAliases(t *testing.T) {
+	keys := make(map[string]bool)
+	fileType := reflect.TypeOf(configFile{})
+	for i := 0; i < fileType.NumField(); i++ {
+		keys[fileType.Field(i).Tag.Get("toml")] = true
+	}
+	for alias, name := range flagAliases {
+		if !keys[alias] || !keys[name] {
+			t.Errorf("configFile lacks “%v” or “%v”", alias, name)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"go4.org/must"
+	"golang.org/x/exp/maps"
+)
+
+// outputFormat creates the lines of the output file.  All domains are passed
+// without the leading “.” of the internal representation.  The returned lines
+// do not contain the trailing newline.  A format may return more than one
+// line for a domain, separated by newlines.
+type outputFormat interface {
+	// blacklistLine returns the line for a minimal blacklisted domain.
+	blacklistLine(domain string) string
+	// whitelistLine returns the line for a domain that needs to be
+	// whitelisted explicitly.  If the format does not need such a line, the
+	// empty string is returned.  If the format cannot express explicit
+	// whitelisting, an error is returned.
+	whitelistLine(domain string) (string, error)
+	// parseLine is the inverse of the two methods above.  It returns the
+	// domain of a line of an existing output file and whether it is
+	// whitelisted.  If the line does not contain a domain, e.g. because it
+	// belongs to a header, “ok” is false.  Only the first line of
+	// multi-line entries yields the domain.
+	parseLine(line string) (domain string, whitelisted, ok bool)
+	// commentPrefix returns the string starting a comment in the format, or
+	// the empty string if the format does not support comments.
+	commentPrefix() string
+}
+
+// headerFormat is implemented by output formats which need some lines at the
+// beginning of the output file.
+type headerFormat interface {
+	// header returns the lines, including their trailing newlines.
+	header() string
+}
+
+// companionFormat is implemented by output formats which cannot express
+// explicit whitelisting in the output file itself, but in a separate file next
+// to it, see writeWhitelist.
+type companionFormat interface {
+	// whitelistPath returns the path of the whitelist file for the output
+	// file at “path”.
+	whitelistPath(path string) string
+}
+
+// multiLineFormat is implemented by output formats creating more than one line
+// per domain.
+type multiLineFormat interface {
+	// isContinuation returns whether “line” is a valid further line of an
+	// entry, i.e. not its first one, which is handled by parseLine.
+	isContinuation(line string) bool
+}
+
+// dnsmasqFormat creates input for the “servers-file” directive of dnsmasq.
+type dnsmasqFormat struct {
+	// whitelistTarget is the upstream server whitelisted domains are
+	// forwarded to, or “#” for the standard servers.
+	whitelistTarget string
+}
+
+func (dnsmasqFormat) blacklistLine(domain string) string {
+	return fmt.Sprintf("server=/%s/", domain)
+}
+
+func (f dnsmasqFormat) whitelistLine(domain string) (string, error) {
+	return fmt.Sprintf("server=/%s/%s", domain, f.whitelistTarget), nil
+}
+
+// dnsmasqRegexp matches a line of dnsmasqFormat.  The first group captures the
+// domain, the second one the upstream server for whitelisted domains, e.g.
+// “#”, and is empty for blacklisted ones.
+var dnsmasqRegexp = regexp.MustCompile(`^server=/([^/]+)/(\S*)$`)
+
+func (dnsmasqFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	match := dnsmasqRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return "", false, false
+	}
+	return match[1], match[2] != "", true
+}
+
+func (dnsmasqFormat) commentPrefix() string {
+	return "#"
+}
+
+// hostsFormat creates a hosts file.  Since a hosts file blocks only the very
+// domains listed in it, whitelisted subdomains need no line of their own.
+// Mind that for the same reason, subdomains of blacklisted domains are not
+// blocked by the resulting file.
+type hostsFormat struct {
+	// sinkAddress is the IP address the blacklisted domains resolve to.
+	sinkAddress string
+}
+
+func (f hostsFormat) blacklistLine(domain string) string {
+	return f.sinkAddress + " " + domain
+}
+
+func (hostsFormat) whitelistLine(domain string) (string, error) {
+	return "", nil
+}
+
+func (hostsFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || net.ParseIP(fields[0]) == nil {
+		return "", false, false
+	}
+	return fields[1], false, true
+}
+
+func (hostsFormat) commentPrefix() string {
+	return "#"
+}
+
+// plainFormat creates a list of bare domain names.  It cannot express
+// explicit whitelisting.
+type plainFormat struct{}
+
+func (plainFormat) blacklistLine(domain string) string {
+	return domain
+}
+
+func (plainFormat) whitelistLine(domain string) (string, error) {
+	return "", errors.New("Output format “plain” cannot express explicitly whitelisted domains")
+}
+
+func (plainFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	line = strings.TrimSpace(line)
+	return line, false, line != "" && !strings.HasPrefix(line, "#")
+}
+
+func (plainFormat) commentPrefix() string {
+	return ""
+}
+
+// piholeFormat creates a list of bare domain names for the gravity database of
+// Pi-hole.  The explicitly whitelisted domains go to a separate file, which can
+// be imported as an exact whitelist.
+type piholeFormat struct{}
+
+func (piholeFormat) blacklistLine(domain string) string {
+	return domain
+}
+
+func (piholeFormat) whitelistLine(domain string) (string, error) {
+	return "", nil
+}
+
+func (piholeFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	line = strings.TrimSpace(line)
+	return line, false, line != "" && !strings.HasPrefix(line, "#")
+}
+
+func (piholeFormat) commentPrefix() string {
+	return "#"
+}
+
+func (piholeFormat) whitelistPath(path string) string {
+	return path + ".whitelist"
+}
+
+// unboundFormat creates “local-zone” directives for unbound.
+type unboundFormat struct{}
+
+func (unboundFormat) blacklistLine(domain string) string {
+	return fmt.Sprintf(`local-zone: "%s." always_nxdomain`, domain)
+}
+
+func (unboundFormat) whitelistLine(domain string) (string, error) {
+	return fmt.Sprintf(`local-zone: "%s." transparent`, domain), nil
+}
+
+// unboundRegexp matches a line of unboundFormat.  The first group captures the
+// domain, the second one the zone type.
+var unboundRegexp = regexp.MustCompile(`^local-zone: "([^"]+)\." (always_nxdomain|transparent)$`)
+
+func (unboundFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	match := unboundRegexp.FindStringSubmatch(line)
+	if match == nil {
+		return "", false, false
+	}
+	return match[1], match[2] == "transparent", true
+}
+
+func (unboundFormat) commentPrefix() string {
+	return "#"
+}
+
+// rpzFormat creates a Response Policy Zone for BIND or PowerDNS.  The owner
+// names are relative to the zone name given in the server configuration.
+// Every domain gets a second record with a wildcard, because a record in an
+// RPZ matches only the very name.
+type rpzFormat struct{}
+
+// header returns the SOA and NS records of the zone.  The SOA serial is the
+// current Unix time, so that it increases with every run.
+func (rpzFormat) header() string {
+	return fmt.Sprintf("$TTL 300\n@ IN SOA localhost. root.localhost. %d 3600 600 86400 300\n  IN NS localhost.\n",
+		time.Now().Unix())
+}
+
+func (rpzFormat) blacklistLine(domain string) string {
+	return fmt.Sprintf("%s CNAME .\n*.%s CNAME .", domain, domain)
+}
+
+func (rpzFormat) whitelistLine(domain string) (string, error) {
+	return fmt.Sprintf("%s CNAME rpz-passthru.\n*.%s CNAME rpz-passthru.", domain, domain), nil
+}
+
+func (rpzFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[1] != "CNAME" || strings.HasPrefix(fields[0], "*.") {
+		return "", false, false
+	}
+	switch fields[2] {
+	case ".":
+		return fields[0], false, true
+	case "rpz-passthru.":
+		return fields[0], true, true
+	}
+	return "", false, false
+}
+
+func (rpzFormat) commentPrefix() string {
+	return ";"
+}
+
+func (f rpzFormat) isContinuation(line string) bool {
+	line, wildcard := strings.CutPrefix(line, "*.")
+	_, _, ok := f.parseLine(line)
+	return wildcard && ok
+}
+
+// annotatedFormat wraps another output format and appends a comment with the
+// names of the lists a blacklisted domain was found in to its line.  For
+// entries consisting of several lines, the comment is appended to the first
+// one.
+type annotatedFormat struct {
+	outputFormat
+	// sources returns the names of the lists “domain” was found in.
+	sources func(domain string) []string
+}
+
+// newAnnotatedFormat returns “format” wrapped in an annotatedFormat.  It
+// returns an error if “format” does not support comments.
+func newAnnotatedFormat(format outputFormat, sources func(domain string) []string) (annotatedFormat, error) {
+	if format.commentPrefix() == "" {
+		return annotatedFormat{}, errors.New("Output format does not support comments")
+	}
+	return annotatedFormat{format, sources}, nil
+}
+
+func (f annotatedFormat) blacklistLine(domain string) string {
+	sources := f.sources(domain)
+	if len(sources) == 0 {
+		return f.outputFormat.blacklistLine(domain)
+	}
+	first, rest, hasRest := strings.Cut(f.outputFormat.blacklistLine(domain), "\n")
+	line := first + " " + f.commentPrefix() + " from " + strings.Join(sources, ", ")
+	if hasRest {
+		line += "\n" + rest
+	}
+	return line
+}
+
+// header passes through the header of the wrapped format, if it has one.
+func (f annotatedFormat) header() string {
+	if format, ok := f.outputFormat.(headerFormat); ok {
+		return format.header()
+	}
+	return ""
+}
+
+// templateData is passed to the templates of templateFormat.
+type templateData struct {
+	Domain string
+}
+
+// templateMarker is rendered into a template instead of a domain in order to
+// find out what surrounds the domain, see linePattern.
+const templateMarker = "\x00"
+
+// linePattern is the text before and after the domain in the lines created by
+// a template.  It is used to parse such lines.
+type linePattern struct {
+	prefix, suffix string
+}
+
+// newLinePattern executes “t” with templateMarker as the domain and returns
+// the resulting linePattern.  This also validates the template.  It returns
+// an error if the template cannot be executed or does not contain the domain.
+func newLinePattern(t *template.Template) (linePattern, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, templateData{templateMarker}); err != nil {
+		return linePattern{}, err
+	}
+	prefix, suffix, found := strings.Cut(b.String(), templateMarker)
+	if !found {
+		return linePattern{}, fmt.Errorf("Template “%v” does not contain {{.Domain}}", t.Name())
+	}
+	prefix = prefix[strings.LastIndex(prefix, "\n")+1:]
+	suffix, _, _ = strings.Cut(suffix, "\n")
+	return linePattern{prefix, suffix}, nil
+}
+
+// parse returns the domain in “line” if the line matches the pattern.
+func (p linePattern) parse(line string) (domain string, ok bool) {
+	if !strings.HasPrefix(line, p.prefix) || !strings.HasSuffix(line, p.suffix) ||
+		len(line) <= len(p.prefix)+len(p.suffix) {
+		return "", false
+	}
+	domain = line[len(p.prefix) : len(line)-len(p.suffix)]
+	return domain, !strings.ContainsAny(domain, " \t/")
+}
+
+// templateFormat wraps another output format and creates the lines of
+// blacklisted and whitelisted domains with Go templates instead, see
+// text/template.  The templates get a templateData.  If one of them is nil,
+// the wrapped format is used for these lines.
+type templateFormat struct {
+	outputFormat
+	blacklist, whitelist               *template.Template
+	blacklistPattern, whitelistPattern linePattern
+}
+
+// newTemplateFormat returns “format” wrapped in a templateFormat with the
+// templates “blacklistText” and “whitelistText”.  An empty template text
+// means that the line of the wrapped format is used.  It returns an error if a
+// template is invalid.
+func newTemplateFormat(format outputFormat, blacklistText, whitelistText string) (f templateFormat, err error) {
+	f.outputFormat = format
+	if blacklistText != "" {
+		if f.blacklist, err = template.New("blacklist").Parse(blacklistText); err != nil {
+			return templateFormat{}, err
+		}
+		if f.blacklistPattern, err = newLinePattern(f.blacklist); err != nil {
+			return templateFormat{}, err
+		}
+	}
+	if whitelistText != "" {
+		if f.whitelist, err = template.New("whitelist").Parse(whitelistText); err != nil {
+			return templateFormat{}, err
+		}
+		if f.whitelistPattern, err = newLinePattern(f.whitelist); err != nil {
+			return templateFormat{}, err
+		}
+	}
+	return f, nil
+}
+
+func (f templateFormat) blacklistLine(domain string) string {
+	if f.blacklist == nil {
+		return f.outputFormat.blacklistLine(domain)
+	}
+	var b strings.Builder
+	// The template was executed successfully in newLinePattern already, and
+	// the domain is the only data it gets, so this cannot fail.
+	must.Do(func() error {
+		return f.blacklist.Execute(&b, templateData{domain})
+	})
+	return b.String()
+}
+
+func (f templateFormat) whitelistLine(domain string) (string, error) {
+	if f.whitelist == nil {
+		return f.outputFormat.whitelistLine(domain)
+	}
+	var b strings.Builder
+	err := f.whitelist.Execute(&b, templateData{domain})
+	return b.String(), err
+}
+
+// parseLine recognises the lines created by the templates, and falls back to
+// the wrapped format for lines without a template.
+func (f templateFormat) parseLine(line string) (domain string, whitelisted, ok bool) {
+	if f.whitelist != nil {
+		if domain, ok := f.whitelistPattern.parse(line); ok {
+			return domain, true, true
+		}
+	}
+	if f.blacklist != nil {
+		if domain, ok := f.blacklistPattern.parse(line); ok {
+			return domain, false, true
+		}
+	}
+	domain, whitelisted, ok = f.outputFormat.parseLine(line)
+	if ok && (whitelisted && f.whitelist != nil || !whitelisted && f.blacklist != nil) {
+		return "", false, false
+	}
+	return
+}
+
+// header passes through the header of the wrapped format, if it has one.
+func (f templateFormat) header() string {
+	if format, ok := f.outputFormat.(headerFormat); ok {
+		return format.header()
+	}
+	return ""
+}
+
+// outputFormats maps the valid values of the “-output-format” option to their
+// implementations.
+var outputFormats = map[string]outputFormat{
+	"dnsmasq": dnsmasqFormat{"#"},
+	"hosts":   hostsFormat{"0.0.0.0"},
+	"pihole":  piholeFormat{},
+	"plain":   plainFormat{},
+	"rpz":     rpzFormat{},
+	"unbound": unboundFormat{},
+}
+
+// outputFormatNames returns the sorted names of all output formats.
+func outputFormatNames() []string {
+	names := maps.Keys(outputFormats)
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnboundFormat(t *testing.T) {
+	var format unboundFormat
+	if got, want := format.blacklistLine("ads.example.com"), `local-zone: "ads.example.com." always_nxdomain`; got != want {
+		t.Errorf("got blacklist line %q, want %q", got, want)
+	}
+	line, err := format.whitelistLine("ok.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `local-zone: "ok.example.com." transparent`; line != want {
+		t.Errorf("got whitelist line %q, want %q", line, want)
+	}
+	if domain, whitelisted, ok := format.parseLine(line); !ok || !whitelisted || domain != "ok.example.com" {
+		t.Errorf("parseLine(%q) = %q, %v, %v", line, domain, whitelisted, ok)
+	}
+}
+
+func TestRPZFormat(t *testing.T) {
+	var stdout bytes.Buffer
+	start := time.Now().Unix()
+	err := writeOutput(context.Background(), "-", &stdout, rpzFormat{}, []string{"ok.example.com"},
+		testMinimizer("ads.example.com"), testWriteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 7:\n%v", len(lines), stdout.String())
+	}
+	if lines[0] != "$TTL 300" {
+		t.Errorf("got first line %q, want the TTL", lines[0])
+	}
+	soa := strings.Fields(lines[1])
+	if len(soa) != 10 || soa[0] != "@" || soa[1] != "IN" || soa[2] != "SOA" {
+		t.Fatalf("got %q, want the SOA record", lines[1])
+	}
+	if serial, err := strconv.ParseInt(soa[5], 10, 64); err != nil || serial < start || serial > time.Now().Unix() {
+		t.Errorf("got SOA serial %q, want the current Unix time", soa[5])
+	}
+	if fields := strings.Fields(lines[2]); len(fields) != 3 || fields[0] != "IN" || fields[1] != "NS" {
+		t.Errorf("got %q, want the NS record", lines[2])
+	}
+	want := []string{"ok.example.com CNAME rpz-passthru.", "*.ok.example.com CNAME rpz-passthru.",
+		"ads.example.com CNAME .", "*.ads.example.com CNAME ."}
+	if got := lines[3:]; !slices.Equal(got, want) {
+		t.Errorf("got records %q, want %q", got, want)
+	}
+}
+
+func TestTemplateFormat(t *testing.T) {
+	for _, test := range []struct {
+		blacklist, whitelist, wantBlacklist, wantWhitelist string
+	}{
+		{"", "", "server=/ads.example.com/", "server=/ok.example.com/#"},
+		{"address=/{{.Domain}}/0.0.0.0", "", "address=/ads.example.com/0.0.0.0", "server=/ok.example.com/#"},
+		{"local=/{{.Domain}}/", "server=/{{.Domain}}/1.1.1.1", "local=/ads.example.com/",
+			"server=/ok.example.com/1.1.1.1"},
+	} {
+		format, err := newTemplateFormat(dnsmasqFormat{whitelistTarget: "#"}, test.blacklist, test.whitelist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := format.blacklistLine("ads.example.com"); got != test.wantBlacklist {
+			t.Errorf("got blacklist line %q, want %q", got, test.wantBlacklist)
+		}
+		if got, err := format.whitelistLine("ok.example.com"); err != nil || got != test.wantWhitelist {
+			t.Errorf("got whitelist line %q (%v), want %q", got, err, test.wantWhitelist)
+		}
+	}
+	for _, text := range []string{"server=/{{.Domain/", "server=/{{.Name}}/", "server=/example.com/"} {
+		if _, err := newTemplateFormat(dnsmasqFormat{whitelistTarget: "#"}, text, ""); err == nil {
+			t.Errorf("invalid template %q did not fail", text)
+		}
+	}
+}
@@ -3,7 +3,12 @@ module github.com/bronger/apply_my_lists
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/mattn/go-sqlite3 v1.14.39
 	gitlab.com/bronger/tools v0.0.0-20230825105701-52687403a66d
 	go4.org v0.0.0-20230225012048-214862532bf5
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df
+	golang.org/x/net v0.15.0
 )
+
+require golang.org/x/text v0.13.0 // indirect
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+	"go4.org/must"
+)
+
+// inputCache stores the large blacklist in minimised form, with its exceptions
+// already applied, so that it needs to be neither parsed nor minimised again as
+// long as it does not change.  Then, only the personal lists are applied to
+// it.  Every entry consists of two files in “dir”: the minimal domains, one per
+// line, named after the key, see inputCache.key, and the explicitly
+// whitelisted domains in the same file with “.whitelist” appended.  Old
+// entries are never removed.
+type inputCache struct {
+	dir     string
+	sources sourceReader
+}
+
+// inputCacheBypass returns why the input cache must not be used for “cfg”, or
+// the empty string if it can be used.  Some options need the large blacklist
+// as it was read, and so do removal entries in the blacklists, which are given
+// as “blacklisted”, since they may uncover non-minimal domains.
+func inputCacheBypass(cfg config, blacklisted []string) string {
+	switch {
+	case slices.Contains(cfg.inputPaths, "-"):
+		return "input is read from stdin"
+	case cfg.annotate:
+		return "-annotate needs the sources of the domains"
+	case cfg.keepPath != "":
+		return "-regex-keep needs all domains of the input"
+	case cfg.listTLDs:
+		return "-list-tlds needs all domains of the input"
+	case cfg.lintWhitelist:
+		return "-lint-whitelist needs all domains of the input"
+	case len(cfg.whitelistExactPaths) > 0:
+		return "-whitelist-exact may uncover non-minimal domains"
+	}
+	for _, entry := range blacklisted {
+		if strings.HasPrefix(entry, "-") {
+			return "blacklist contains removal entries"
+		}
+	}
+	return ""
+}
+
+// key returns the key of the cache entry for the large blacklist files at
+// “paths”.  It is the SHA-256 of the options which influence the reading, and of
+// the contents of the files, which are read completely for this.
+func (c inputCache) key(ctx context.Context, paths []string, options applymylists.ReadOptions) (string, error) {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v %v %d %d %q %q %v %v\n", options.Format, options.Strict, options.MaxDomainLength,
+		options.MaxSubdomainDepth, options.ExcludedTLDs, options.OnlyTLDs, options.Since, options.HostRegexp)
+	for _, path := range paths {
+		if err := c.hashFile(ctx, hash, path); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// hashFile writes the content of the file at “path” to “hash”, followed by its
+// length, so that the boundaries between several files are part of the key.  If
+// “path” is a URL, its content is kept in a local file, see
+// sourceReader.downloads, so that it is not downloaded again for reading it.
+func (c inputCache) hashFile(ctx context.Context, hash io.Writer, path string) error {
+	f, err := c.sources.open(ctx, path)
+	if err != nil {
+		return fmt.Errorf("Could not open domains file “%v”: %w", path, err)
+	}
+	defer must.Close(f)
+	var r io.Reader = f
+	var tmpFile *os.File
+	if isURL(path) && c.sources.downloads != nil {
+		if file, ok := f.(*os.File); ok {
+			// The download cache has a local copy already.
+			c.sources.downloads[path] = download{path: file.Name()}
+		} else {
+			if tmpFile, err = os.CreateTemp("", "apply_my_lists-*"); err != nil {
+				return fmt.Errorf("Could not create temporary file: %w", err)
+			}
+			c.sources.downloads[path] = download{path: tmpFile.Name(), temporary: true}
+			r = io.TeeReader(f, tmpFile)
+		}
+	}
+	length, err := io.Copy(hash, r)
+	if tmpFile != nil {
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Could not read domains file “%v”: %w", path, err)
+	}
+	fmt.Fprintf(hash, "\n%d\n", length)
+	return nil
+}
+
+// load reads the cache entry “key”.  “hit” is false if there is no such entry.
+// “options” are applied to the cached domains, except for the format and the
+// tracking of sources.
+func (c inputCache) load(ctx context.Context, key string, options applymylists.ReadOptions) (
+	domains *applymylists.Domains, explicit []string, hit bool, err error) {
+	domainsPath := filepath.Join(c.dir, key)
+	if _, err := os.Stat(domainsPath); err != nil {
+		return nil, nil, false, nil
+	}
+	options.Format = applymylists.FormatPlain
+	options.Source = ""
+	domains, _, err = c.sources.readDomains(ctx, domainsPath, options)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	explicit, err = c.sources.readList(ctx, domainsPath+".whitelist", options)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return domains, explicit, true, nil
+}
+
+// store minimises “domains”, which empties it, see applymylists.Minimize, and
+// writes the result together with “explicit”, the explicitly whitelisted
+// domains, to the cache entry “key”.  The domains file is written last, so that
+// an entry is complete as soon as it exists.
+func (c inputCache) store(ctx context.Context, key string, domains *applymylists.Domains, explicit []string,
+	workers int) error {
+	minimal, err := applymylists.Minimize(ctx, domains, workers, nil)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("Could not create cache directory “%v”: %w", c.dir, err)
+	}
+	domainsPath := filepath.Join(c.dir, key)
+	if err := writeCacheFile(domainsPath+".whitelist", explicit); err != nil {
+		return err
+	}
+	return writeCacheFile(domainsPath, minimal)
+}
+
+// writeCacheFile writes “lines” to the file at “path”.  It writes to a
+// temporary file first, which is renamed afterwards, so that “path” never
+// contains partial content.
+func writeCacheFile(path string, lines []string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Could not create cache file: %w", err)
+	}
+	var content strings.Builder
+	for _, line := range lines {
+		content.WriteString(line)
+		content.WriteByte('\n')
+	}
+	_, err = io.WriteString(tmpFile, content.String())
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Could not write cache file “%v”: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// cacheEntries returns the paths of the domain files in the input cache “dir”.
+func cacheEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry, ".whitelist") {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+func TestInputCache(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n", "",
+		"ok.ads.example.com\n")
+	cfg.inputCacheDir = filepath.Join(dir, "cache")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ok.ads.example.com/#\nserver=/ads.example.com/\n"; got != want {
+		t.Errorf("cache miss: got output %q, want %q", got, want)
+	}
+	entries := cacheEntries(t, cfg.inputCacheDir)
+	if len(entries) != 1 {
+		t.Fatalf("got cache entries %q, want one", entries)
+	}
+	// If the cache is hit, the input is neither parsed nor minimised, so the
+	// tampered entry shows up in the output.
+	writeTestFile(t, cfg.inputCacheDir, filepath.Base(entries[0]), "cached.example.com\n")
+	writeTestFile(t, dir, "blacklist", "evil.example.org\n")
+	stdout.Reset()
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/cached.example.com/\nserver=/evil.example.org/\n"; got != want {
+		t.Errorf("cache hit: got output %q, want %q", got, want)
+	}
+	writeTestFile(t, dir, "input", "0.0.0.0 tracker.example.net\n")
+	stdout.Reset()
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/tracker.example.net/\nserver=/evil.example.org/\n"; got != want {
+		t.Errorf("changed input: got output %q, want %q", got, want)
+	}
+	if entries := cacheEntries(t, cfg.inputCacheDir); len(entries) != 2 {
+		t.Errorf("got cache entries %q, want two", entries)
+	}
+	if _, err := os.Stat(entries[0] + ".whitelist"); err != nil {
+		t.Errorf("whitelist of the cache entry is missing: %v", err)
+	}
+}
+
+func TestInputCacheBypass(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+	cfg.inputCacheDir = filepath.Join(dir, "cache")
+	cfg.keepPath = writeTestFile(t, dir, "keep", "^ads\\.\n")
+	if reason := inputCacheBypass(cfg, nil); !strings.HasPrefix(reason, "-regex-keep ") {
+		t.Errorf("got reason %q, want one naming -regex-keep", reason)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if entries := cacheEntries(t, cfg.inputCacheDir); len(entries) != 0 {
+		t.Errorf("got cache entries %q despite -regex-keep", entries)
+	}
+}
+
+func TestInputCacheBypassInspection(t *testing.T) {
+	for _, test := range []struct {
+		option string
+		modify func(cfg *config)
+	}{
+		{"-list-tlds", func(cfg *config) { cfg.listTLDs = true }},
+		{"-lint-whitelist", func(cfg *config) { cfg.lintWhitelist = true }},
+	} {
+		cfg, _, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+		test.modify(&cfg)
+		if reason := inputCacheBypass(cfg, nil); !strings.HasPrefix(reason, test.option+" ") {
+			t.Errorf("got reason %q, want one naming %v", reason, test.option)
+		}
+	}
+}
+
+// TestInputCacheURL checks that an input file given as a URL is downloaded
+// only once, although it is read both for the key and for the domains.
+func TestInputCacheURL(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n")
+	}))
+	defer server.Close()
+	cfg, dir, stdout := newTestConfig(t, "", "", "")
+	cfg.inputPaths = []string{server.URL + "/hosts"}
+	cfg.inputCacheDir = filepath.Join(dir, "cache")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+	"go4.org/must"
+	"golang.org/x/exp/maps"
+)
+
+// minimizer runs the minimisation and calls “yield” with the sorted minimal
+// domains of one TLD after the other, see applymylists.MinimizeStream.
+type minimizer func(yield func(tldMinimal []string) error) error
+
+// sortOrders maps the valid values of the “-sort-output” option to functions
+// sorting the minimal domains of one TLD in place.
+var sortOrders = map[string]func(domains []string){
+	"none":    func([]string) {},
+	"lexical": slices.Sort[[]string],
+	"length":  sortByLength,
+}
+
+// sortByLength sorts “domains” in place by their length, and domains of the
+// same length lexically.
+func sortByLength(domains []string) {
+	slices.SortFunc(domains, func(a, b string) int {
+		if len(a) != len(b) {
+			return len(a) - len(b)
+		}
+		return strings.Compare(a, b)
+	})
+}
+
+// writeLines writes the explicitly whitelisted domains “whitelisted” and the
+// minimal domains to “w” in the given format.  The minimal domains are written
+// while “minimize” creates them, so that they need not be held in memory all at
+// once.  If “gzipped” is true, the output is gzip-compressed.  If the format
+// needs a header, it is written first.  Then follow the whitelisted domains,
+// sorted lexically in place, and the minimal domains in the order in which
+// “minimize” yields them, see sortOrders.
+func writeLines(w io.Writer, gzipped bool, format outputFormat, whitelisted []string, minimize minimizer) (err error) {
+	slices.Sort(whitelisted)
+	if gzipped {
+		gz := gzip.NewWriter(w)
+		defer func() {
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = gz
+	}
+	bw := bufio.NewWriter(w)
+	if format, ok := format.(headerFormat); ok {
+		if _, err := bw.WriteString(format.header()); err != nil {
+			return err
+		}
+	}
+	for _, domain := range whitelisted {
+		line, err := format.whitelistLine(domain)
+		if err != nil {
+			return fmt.Errorf("Cannot write whitelisted domain “%v”: %w", domain, err)
+		}
+		if line == "" {
+			continue
+		}
+		if _, err := bw.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	err = minimize(func(tldMinimal []string) error {
+		for _, domain := range tldMinimal {
+			if _, err := bw.WriteString(format.blacklistLine(domain) + "\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// retryPolicy controls how often and how fast writeOutput retries operations
+// which failed with transient errors, see isTransient.
+type retryPolicy struct {
+	// attempts is the total number of attempts; 1 means no retries.
+	attempts int
+	// delay is the waiting time before the first retry.  It doubles with
+	// every further retry.
+	delay time.Duration
+}
+
+// isTransient returns whether “err” may go away by itself, e.g. an I/O error on
+// a busy network file system.  Permanent errors like missing permissions are
+// not transient.
+func isTransient(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.EAGAIN, syscall.EBUSY, syscall.ETIMEDOUT,
+		syscall.EINTR} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls “operation” until it succeeds, fails with an error which is not
+// transient, or the attempts are exhausted.  It returns the last error.  The
+// waiting between attempts is aborted if “ctx” is cancelled.
+func (p retryPolicy) do(ctx context.Context, operation func() error) error {
+	delay := p.delay
+	for attempt := 1; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= p.attempts || !isTransient(err) {
+			return err
+		}
+		slog.Warn("Transient error; retrying", "error", err, "attempt", attempt, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// writeOptions controls how writeOutput writes the output file.
+type writeOptions struct {
+	retry retryPolicy
+	// checksum makes writeOutput write the SHA-256 of the output file to a
+	// file next to it.
+	checksum bool
+	// validate is the format the output file is checked against before it
+	// replaces the old one, see validateOutput.  If it is nil, the output
+	// file is not checked.
+	validate outputFormat
+}
+
+// writeOutput writes the output file to “path”, see writeLines.  If “path”
+// ends in “.gz”, the output is gzip-compressed.  The data is written to a
+// temporary file next to “path” first, which is renamed to “path” only after
+// everything was written successfully.  This way, dnsmasq never sees a
+// truncated file.  On error, the temporary file is removed.  If “ctx” is
+// cancelled, the output is considered incomplete and discarded, too.  Creating
+// and renaming the temporary file is retried according to “options.retry”.  If
+// “options.checksum” is true, the SHA-256 of the file contents is written to
+// “path” with “.sha256” appended, in the format of sha256sum.  If “path” is
+// “-”, the output is written uncompressed to “stdout” instead, without any of
+// these precautions.  If “options.validate” is set, the temporary file is
+// checked with validateOutput before the renaming, so that an invalid file
+// never replaces the old one.
+func writeOutput(ctx context.Context, path string, stdout io.Writer, format outputFormat, whitelisted []string,
+	minimize minimizer, options writeOptions) (err error) {
+	if path == "-" {
+		if err := writeLines(stdout, false, format, whitelisted, minimize); err != nil {
+			return fmt.Errorf("Error while writing output to stdout: %w", err)
+		}
+		return nil
+	}
+	tmpPath := path + ".tmp"
+	var f *os.File
+	err = options.retry.do(ctx, func() (err error) {
+		f, err = os.Create(tmpPath)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Could not create output file “%v”: %w", tmpPath, err)
+	}
+	hash := sha256.New()
+	err = writeLines(io.MultiWriter(f, hash), strings.HasSuffix(path, ".gz"), format, whitelisted, minimize)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && options.validate != nil {
+		err = validateOutput(tmpPath, strings.HasSuffix(path, ".gz"), options.validate)
+	}
+	if err == nil {
+		err = options.retry.do(ctx, func() error {
+			return os.Rename(tmpPath, path)
+		})
+	}
+	if err == nil && options.checksum {
+		checksum := fmt.Sprintf("%x  %s\n", hash.Sum(nil), filepath.Base(path))
+		if err := os.WriteFile(path+".sha256", []byte(checksum), 0644); err != nil {
+			return fmt.Errorf("Could not write checksum file: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("Error while writing output file “%v”: %w", path, err)
+	}
+	return nil
+}
+
+// validateOutput checks that every line of the output file at “path” is valid
+// in “format”, i.e. it is a comment line, or it contains a domain which is
+// valid and normalised, or it continues a multi-line entry, see
+// multiLineFormat.  Trailing comments are ignored, and so are the lines of the
+// header if “format” has one.  If “gzipped” is true, the file is decompressed
+// first.  The first invalid line is returned as an error.
+func validateOutput(path string, gzipped bool, format outputFormat) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer must.Close(f)
+	var r io.Reader = f
+	if gzipped {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer must.Close(gz)
+		r = gz
+	}
+	var numberHeaderLines int
+	if format, ok := format.(headerFormat); ok {
+		numberHeaderLines = strings.Count(format.header(), "\n")
+	}
+	prefix := format.commentPrefix()
+	scanner := bufio.NewScanner(r)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if lineNumber <= numberHeaderLines || prefix != "" && strings.HasPrefix(line, prefix) {
+			continue
+		}
+		if prefix != "" {
+			line, _, _ = strings.Cut(line, " "+prefix+" ")
+		}
+		if domain, _, ok := format.parseLine(line); ok {
+			normalized, err := applymylists.NormalizeDomain(domain)
+			if err != nil {
+				return fmt.Errorf("Invalid domain in line %d: %w", lineNumber, err)
+			}
+			if normalized != domain {
+				return fmt.Errorf("Domain “%v” in line %d is not normalised", domain, lineNumber)
+			}
+			continue
+		}
+		if format, ok := format.(multiLineFormat); ok && format.isContinuation(line) {
+			continue
+		}
+		return fmt.Errorf("Invalid line %d: “%v”", lineNumber, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Read error after line %d: %w", lineNumber, err)
+	}
+	return nil
+}
+
+// splitPath returns the path of the part of the output file at “path” which
+// contains the domains of the top level domain “tld”.  “tld” is inserted
+// before a “.gz” suffix, so that the part is compressed, too.
+func splitPath(path, tld string) string {
+	if base, gzipped := strings.CutSuffix(path, ".gz"); gzipped {
+		return base + "." + tld + ".gz"
+	}
+	return path + "." + tld
+}
+
+// writeSplitOutput is like writeOutput, but writes one file per top level
+// domain, i.e. the last label of the domains, see splitPath.  The whitelisted
+// domains go to the file of their top level domain, too.  Since the files are
+// written one after the other, all minimal domains are collected in memory
+// first.  Files of top level domains which no longer occur are left alone.
+func writeSplitOutput(ctx context.Context, path string, format outputFormat, whitelisted []string,
+	minimize minimizer, options writeOptions) error {
+	minimalByTLD := make(map[string][]string)
+	err := minimize(func(tldMinimal []string) error {
+		for _, domain := range tldMinimal {
+			tld := domain[strings.LastIndexByte(domain, '.')+1:]
+			minimalByTLD[tld] = append(minimalByTLD[tld], domain)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	whitelistedByTLD := make(map[string][]string)
+	for _, domain := range whitelisted {
+		tld := domain[strings.LastIndexByte(domain, '.')+1:]
+		whitelistedByTLD[tld] = append(whitelistedByTLD[tld], domain)
+	}
+	tlds := maps.Keys(minimalByTLD)
+	for tld := range whitelistedByTLD {
+		if _, ok := minimalByTLD[tld]; !ok {
+			tlds = append(tlds, tld)
+		}
+	}
+	slices.Sort(tlds)
+	for _, tld := range tlds {
+		minimal := minimalByTLD[tld]
+		err := writeOutput(ctx, splitPath(path, tld), nil, format, whitelistedByTLD[tld],
+			func(yield func(tldMinimal []string) error) error {
+				return yield(minimal)
+			}, options)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("Wrote output files", "number", len(tlds))
+	return nil
+}
+
+// writeWhitelist writes the explicitly whitelisted domains “whitelisted” to the
+// file at “path”, sorted lexically in place and one per line, for auditing.
+// Since the file is written, an error when closing it is returned, too.
+func writeWhitelist(path string, whitelisted []string) (err error) {
+	slices.Sort(whitelisted)
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Could not create whitelist file “%v”: %w", path, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Could not close whitelist file “%v”: %w", path, closeErr)
+		}
+	}()
+	bw := bufio.NewWriter(f)
+	for _, domain := range whitelisted {
+		fmt.Fprintln(bw, domain)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("Could not write whitelist file “%v”: %w", path, err)
+	}
+	return nil
+}
+
+// readOutput reads an existing output file at “path” in the given format for
+// the “-append” option.  It returns the normalised blacklisted and
+// whitelisted domains found in it.  If “path” ends in “.gz”, the file is
+// decompressed.  Comments after the domain, as written with “-annotate”, are
+// ignored.  Lines without a domain are skipped, as are invalid domain names,
+// unless “strict” is true.  A missing file is treated as empty.
+func readOutput(path string, format outputFormat, strict bool) (blacklisted, whitelisted []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Info("Output file does not exist yet; nothing to append to", "path", path)
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("Could not open output file “%v”: %w", path, err)
+	}
+	defer must.Close(f)
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not decompress output file “%v”: %w", path, err)
+		}
+		defer must.Close(gz)
+		r = gz
+	}
+	scanner := bufio.NewScanner(r)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if prefix := format.commentPrefix(); prefix != "" {
+			line, _, _ = strings.Cut(line, " "+prefix+" ")
+		}
+		domain, isWhitelisted, ok := format.parseLine(line)
+		if !ok {
+			slog.Debug("Skipping line without domain in output file", "line", lineNumber)
+			continue
+		}
+		domain, err := applymylists.NormalizeDomain(domain)
+		if err != nil {
+			if strict {
+				return nil, nil, fmt.Errorf("Invalid domain in output file “%v”, line %d: %w", path, lineNumber, err)
+			}
+			slog.Warn("Skipping invalid domain in output file", "path", path, "line", lineNumber, "error", err)
+			continue
+		}
+		if isWhitelisted {
+			whitelisted = append(whitelisted, domain)
+		} else {
+			blacklisted = append(blacklisted, domain)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("Error while reading output file “%v”: %w", path, err)
+	}
+	return
+}
+
+// writeDiff writes the differences between the blacklisted domains “previous”
+// and “current” to the file at “path”, or to “stdout” if “path” is “-”.  Every
+// added domain yields a line “+domain”, every removed one a line “-domain”.
+// Both are sorted, with the added ones coming first.  The order of the input
+// slices does not matter.  All errors, including those when closing the file,
+// are returned rather than leading to a panic.
+func writeDiff(path string, stdout io.Writer, previous, current []string) (added, removed []string, err error) {
+	defer func() {
+		if err != nil {
+			added, removed = nil, nil
+		}
+	}()
+	previousSet := make(map[string]bool, len(previous))
+	for _, domain := range previous {
+		previousSet[domain] = true
+	}
+	currentSet := make(map[string]bool, len(current))
+	for _, domain := range current {
+		currentSet[domain] = true
+		if !previousSet[domain] {
+			added = append(added, domain)
+		}
+	}
+	for domain := range previousSet {
+		if !currentSet[domain] {
+			removed = append(removed, domain)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+	w := stdout
+	if path != "-" {
+		f, createErr := os.Create(path)
+		if createErr != nil {
+			return nil, nil, fmt.Errorf("Could not create diff file “%v”: %w", path, createErr)
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("Could not close diff file “%v”: %w", path, closeErr)
+			}
+		}()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	for _, domain := range added {
+		fmt.Fprintln(bw, "+"+domain)
+	}
+	for _, domain := range removed {
+		fmt.Fprintln(bw, "-"+domain)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("Could not write diff to “%v”: %w", path, err)
+	}
+	return
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testMinimizer returns a minimizer yielding “minimal” as the minimal domains
+// of a single TLD.
+func testMinimizer(minimal ...string) minimizer {
+	return func(yield func(tldMinimal []string) error) error {
+		return yield(minimal)
+	}
+}
+
+// testWriteOptions are the write options for tests: no retries, no checksum,
+// and no validation.
+var testWriteOptions = writeOptions{retry: retryPolicy{attempts: 1}}
+
+func TestWriteOutputGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers-blacklist.gz")
+	err := writeOutput(context.Background(), path, nil, dnsmasqFormat{whitelistTarget: "#"}, []string{"ok.example.com"},
+		testMinimizer("ads.example.com", "evil.example.org"), testWriteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ok.example.com/#\nserver=/ads.example.com/\nserver=/evil.example.org/\n"
+	if string(content) != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+}
+
+func TestWriteOutputPlain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers-blacklist")
+	err := writeOutput(context.Background(), path, nil, dnsmasqFormat{whitelistTarget: "#"}, nil,
+		testMinimizer("ads.example.com"), testWriteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "server=/ads.example.com/\n"; string(content) != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+}
+
+func TestWriteOutputStdout(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	var stdout bytes.Buffer
+	err = writeOutput(context.Background(), "-", &stdout, dnsmasqFormat{whitelistTarget: "#"}, nil,
+		testMinimizer("ads.example.com"), testWriteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "server=/ads.example.com/\n"; stdout.String() != want {
+		t.Errorf("got %q, want %q", stdout.String(), want)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("files were created in the working directory: %v %v", entries, err)
+	}
+}
+
+func TestWriteOutputFailureKeepsOldFile(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "servers-blacklist", "server=/old.example.com/\n")
+	failure := errors.New("simulated failure")
+	err := writeOutput(context.Background(), path, nil, dnsmasqFormat{whitelistTarget: "#"}, nil,
+		func(yield func(tldMinimal []string) error) error {
+			if err := yield([]string{"new.example.com"}); err != nil {
+				return err
+			}
+			return failure
+		}, testWriteOptions)
+	if !errors.Is(err, failure) {
+		t.Fatalf("got error %v, want the simulated failure", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "server=/old.example.com/\n"; string(content) != want {
+		t.Errorf("output file was changed to %q", content)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
+
+// failingWriter fails every write with errWrite.
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestWriteOutputWriteError(t *testing.T) {
+	err := writeOutput(context.Background(), "-", failingWriter{}, dnsmasqFormat{whitelistTarget: "#"}, nil,
+		testMinimizer("ads.example.com"), testWriteOptions)
+	if !errors.Is(err, errWrite) {
+		t.Errorf("got error %v, want %v", err, errWrite)
+	}
+	cfg, _, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+	cfg.stdout = failingWriter{}
+	var exitErr *exitError
+	if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != exitOutput {
+		t.Errorf("got error %v, want exit code %d", err, exitOutput)
+	}
+}
+
+func TestSortOrders(t *testing.T) {
+	for _, test := range []struct {
+		order string
+		want  []string
+	}{
+		{"none", []string{"zz.example.com", "b.example.com", "aaa.example.com", "a.example.com"}},
+		{"lexical", []string{"a.example.com", "aaa.example.com", "b.example.com", "zz.example.com"}},
+		{"length", []string{"a.example.com", "b.example.com", "zz.example.com", "aaa.example.com"}},
+	} {
+		domains := []string{"zz.example.com", "b.example.com", "aaa.example.com", "a.example.com"}
+		sortOrders[test.order](domains)
+		if !slices.Equal(domains, test.want) {
+			t.Errorf("%v: got %q, want %q", test.order, domains, test.want)
+		}
+	}
+}
+
+// flakyOperation returns an operation for retryPolicy.do which fails with
+// “err” the first “failures” times, and the number of calls so far.
+func flakyOperation(failures int, err error) (operation func() error, calls *int) {
+	calls = new(int)
+	return func() error {
+		*calls++
+		if *calls <= failures {
+			return &os.PathError{Op: "open", Path: "output", Err: err}
+		}
+		return nil
+	}, calls
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := retryPolicy{attempts: 3, delay: time.Millisecond}
+	for _, test := range []struct {
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{2, syscall.EIO, 3, false},
+		{3, syscall.EIO, 3, true},
+		{1, syscall.EACCES, 1, true},
+	} {
+		operation, calls := flakyOperation(test.failures, test.err)
+		err := policy.do(context.Background(), operation)
+		if (err != nil) != test.wantErr || *calls != test.wantCalls {
+			t.Errorf("%d failures with %v: got error %v after %d calls, want %d calls", test.failures, test.err,
+				err, *calls, test.wantCalls)
+		}
+	}
+}
+
+func TestWriteOutputChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers-blacklist.gz")
+	options := testWriteOptions
+	options.checksum = true
+	err := writeOutput(context.Background(), path, nil, dnsmasqFormat{whitelistTarget: "#"}, []string{"ok.example.com"},
+		testMinimizer("ads.example.com"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%x  servers-blacklist.gz\n", sha256.Sum256(content)); string(checksum) != want {
+		t.Errorf("got checksum file %q, want %q", checksum, want)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"time"
+)
+
+// startProfiling starts writing a CPU profile to “cpuPath” and prepares writing
+// a heap profile to “memPath”, see runtime/pprof.  An empty path disables the
+// respective profile.  The returned function stops the CPU profile and writes
+// the heap profile; it must be called before the program exits, also on
+// errors, because otherwise the profiles are incomplete.
+func startProfiling(cpuPath, memPath string) (stop func() error, err error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		cpuFile, err = os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("Could not create CPU profile “%v”: %w", cpuPath, err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("Could not start CPU profile: %w", err)
+		}
+	}
+	return func() error {
+		var errs []error
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("Could not write CPU profile “%v”: %w", cpuPath, err))
+			}
+		}
+		if memPath != "" {
+			errs = append(errs, writeHeapProfile(memPath))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+// writeHeapProfile writes a heap profile to “path”.  It runs the garbage
+// collector first, so that the profile is up to date.
+func writeHeapProfile(path string) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Could not create memory profile “%v”: %w", path, err)
+	}
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write memory profile “%v”: %w", path, err)
+	}
+	return nil
+}
+
+// resourceSampleInterval is how often startResourceReport samples the number
+// of goroutines and the size of the heap.
+const resourceSampleInterval = 100 * time.Millisecond
+
+// startResourceReport samples the number of goroutines and the size of the
+// heap every resourceSampleInterval.  runtime/metrics is used for this because,
+// unlike runtime.ReadMemStats, it does not stop the world.  The returned
+// function stops the sampling and logs the peak values together with the
+// memory statistics of the whole run.  Peaks between two samples are missed,
+// so the values are lower bounds.
+func startResourceReport() (stop func()) {
+	samples := []metrics.Sample{
+		{Name: "/sched/goroutines:goroutines"},
+		{Name: "/memory/classes/heap/objects:bytes"},
+	}
+	var peakGoroutines, peakHeapAlloc uint64
+	sample := func() {
+		metrics.Read(samples)
+		if goroutines := samples[0].Value.Uint64(); goroutines > peakGoroutines {
+			peakGoroutines = goroutines
+		}
+		if heapAlloc := samples[1].Value.Uint64(); heapAlloc > peakHeapAlloc {
+			peakHeapAlloc = heapAlloc
+		}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(resourceSampleInterval)
+		defer ticker.Stop()
+		for {
+			sample()
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+		sample()
+		var memStats runtime.MemStats
+		runtime.ReadMemStats(&memStats)
+		slog.Info("Resource usage", "peakGoroutines", peakGoroutines, "peakHeapAlloc", peakHeapAlloc,
+			"heapSys", memStats.HeapSys, "totalAlloc", memStats.TotalAlloc, "sys", memStats.Sys,
+			"numGC", memStats.NumGC)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestProfiling checks that both profiles are written, also if the run fails.
+func TestProfiling(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, oneTLDHosts(1000), "", "")
+	cpuPath, memPath := filepath.Join(dir, "cpu.pprof"), filepath.Join(dir, "mem.pprof")
+	stop, err := startProfiling(cpuPath, memPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.inputPaths = []string{filepath.Join(dir, "missing")}
+	if err := run(context.Background(), cfg); err == nil {
+		t.Error("run with a missing input file did not fail")
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{cpuPath, memPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			t.Errorf("profile %v is empty", filepath.Base(path))
+		}
+	}
+}
+
+func TestProfilingUncreatable(t *testing.T) {
+	if _, err := startProfiling(filepath.Join(t.TempDir(), "missing", "cpu.pprof"), ""); err == nil {
+		t.Error("creating a CPU profile in a missing directory did not fail")
+	}
+}
+
+// TestResourceReport keeps some goroutines alive until the resources were
+// sampled at least once, and checks the logged values.
+func TestResourceReport(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buffer bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buffer, nil)))
+	const numberGoroutines = 20
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < numberGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-release
+		}()
+	}
+	stop := startResourceReport()
+	// The first sample is taken right away, but asynchronously.
+	time.Sleep(resourceSampleInterval)
+	close(release)
+	wg.Wait()
+	stop()
+	var record map[string]any
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buffer.Bytes(), err)
+	}
+	if record["msg"] != "Resource usage" {
+		t.Errorf("got message %q", record["msg"])
+	}
+	if peak, _ := record["peakGoroutines"].(float64); peak < numberGoroutines {
+		t.Errorf("got peak of %v goroutines, want at least %d", record["peakGoroutines"], numberGoroutines)
+	}
+	for _, key := range []string{"peakHeapAlloc", "heapSys", "totalAlloc", "sys"} {
+		if value, _ := record[key].(float64); value <= 0 {
+			t.Errorf("got %v for %v, want a positive number", record[key], key)
+		}
+	}
+	if _, ok := record["numGC"].(float64); !ok {
+		t.Errorf("got %v for numGC, want a number", record["numGC"])
+	}
+}
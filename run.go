@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+	"golang.org/x/exp/maps"
+)
+
+// config holds everything a run of the program depends on.  It is filled from
+// the command line by main.  All I/O not going to named files goes through
+// “stdin”, “stdout”, and “stderr”, so that run can also be used with other
+// readers and writers than those of the process.
+type config struct {
+	inputPaths                     []string
+	blacklistPaths, whitelistPaths []string
+	whitelistExactPaths            []string
+	// keepPath is the path to the regular expressions of “-regex-keep”; it
+	// may be empty.
+	keepPath          string
+	outputPath        string
+	workers           int
+	appendOutput      bool
+	diffPath          string
+	whitelistPath     string
+	writeOptions      writeOptions
+	dryRun            bool
+	validateOutput    bool
+	listTLDs          bool
+	lintWhitelist     bool
+	splitByTLD        bool
+	countOnly         bool
+	normalizeOnly     bool
+	outputFormat      string
+	sortOutput        string
+	sinkAddress       string
+	whitelistForward  string
+	statsJSONPath     string
+	excludedTLDs      []string
+	onlyTLDs          []string
+	inputFormat       string
+	annotate          bool
+	maxDomains        int
+	maxDomainLength   int
+	maxSubdomainDepth int
+	since             string
+	hostRegexp        string
+	mmap              bool
+	strict            bool
+	httpTimeout       time.Duration
+	cacheDir          string
+	inputCacheDir     string
+	timeout           time.Duration
+	progressInterval  time.Duration
+	stdin             io.Reader
+	stdout, stderr    io.Writer
+
+	// template and whitelistTemplate are the texts of the templates for the
+	// lines of the output file, see templateFormat; they may be empty.
+	template, whitelistTemplate string
+}
+
+// exitError is an error returned by run.  It carries the exit code of the
+// program and the message and key–value pairs to be logged, see
+// tbr_errors.ExitWithExpectedError.
+type exitError struct {
+	message string
+	code    int
+	// err is the underlying error; it may be nil.
+	err  error
+	args []any
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// newExitError returns an exitError wrapping “err”, or nil if “err” is nil.
+func newExitError(err error, message string, code int, args ...any) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{message, code, err, args}
+}
+
+// abortError returns an exitError if “ctx” was cancelled, either because the
+// timeout was exceeded or because the program received SIGINT or SIGTERM.  In
+// both cases, the output file is left unchanged, see writeOutput.
+func abortError(ctx context.Context) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return &exitError{message: "Timeout exceeded; output file left unchanged", code: exitTimeout}
+	case context.Canceled:
+		return &exitError{message: "Interrupted by signal; output file left unchanged", code: exitInterrupted}
+	}
+	return nil
+}
+
+// checkConfig validates the options in “cfg” which can be checked before
+// reading anything.  It returns the output format and the read options to
+// use.
+func checkConfig(cfg config) (format outputFormat, readOptions applymylists.ReadOptions, err error) {
+	if cfg.maxDomains < 0 {
+		return nil, readOptions, &exitError{message: "Maximal number of domains must not be negative",
+			code: exitUsage, args: []any{"maxDomains", cfg.maxDomains}}
+	}
+	if cfg.writeOptions.retry.attempts < 1 {
+		return nil, readOptions, &exitError{message: "Number of write attempts must be at least 1", code: exitUsage,
+			args: []any{"attempts", cfg.writeOptions.retry.attempts}}
+	}
+	if cfg.workers < 1 {
+		return nil, readOptions, &exitError{message: "Number of workers must be at least 1", code: exitUsage,
+			args: []any{"workers", cfg.workers}}
+	}
+	format, ok := outputFormats[cfg.outputFormat]
+	if !ok {
+		return nil, readOptions, &exitError{message: "Invalid output format", code: exitUsage,
+			args: []any{"format", cfg.outputFormat}}
+	}
+	if _, ok := sortOrders[cfg.sortOutput]; !ok {
+		return nil, readOptions, &exitError{message: "Invalid sort order", code: exitUsage,
+			args: []any{"order", cfg.sortOutput}}
+	}
+	if net.ParseIP(cfg.sinkAddress) == nil {
+		return nil, readOptions, &exitError{message: "Invalid sink address", code: exitUsage,
+			args: []any{"address", cfg.sinkAddress}}
+	}
+	if hosts, ok := format.(hostsFormat); ok {
+		hosts.sinkAddress = cfg.sinkAddress
+		format = hosts
+	}
+	if cfg.whitelistForward != "#" && net.ParseIP(cfg.whitelistForward) == nil {
+		return nil, readOptions, &exitError{message: "Invalid whitelist forward target", code: exitUsage,
+			args: []any{"target", cfg.whitelistForward}}
+	}
+	if dnsmasq, ok := format.(dnsmasqFormat); ok {
+		dnsmasq.whitelistTarget = cfg.whitelistForward
+		format = dnsmasq
+	}
+	if cfg.appendOutput && cfg.outputPath == "-" {
+		return nil, readOptions, &exitError{message: "Cannot append to stdout", code: exitUsage}
+	}
+	if cfg.diffPath != "" && cfg.outputPath == "-" {
+		return nil, readOptions, &exitError{message: "Cannot compare with stdout", code: exitUsage}
+	}
+	if cfg.validateOutput && cfg.outputPath == "-" {
+		return nil, readOptions, &exitError{message: "Cannot validate stdout", code: exitUsage}
+	}
+	if cfg.splitByTLD && (cfg.outputPath == "-" || cfg.appendOutput || cfg.diffPath != "") {
+		return nil, readOptions, &exitError{message: "Cannot split output to stdout or with -append or -diff",
+			code: exitUsage}
+	}
+	var since time.Time
+	if cfg.since != "" {
+		if since, err = time.Parse("2006-01-02", cfg.since); err != nil {
+			return nil, readOptions, &exitError{message: "Invalid date", code: exitUsage,
+				args: []any{"since", cfg.since}}
+		}
+	}
+	var hostRegexp *regexp.Regexp
+	if cfg.hostRegexp != "" {
+		if hostRegexp, err = regexp.Compile(cfg.hostRegexp); err != nil {
+			return nil, readOptions, newExitError(err, "Invalid host regexp", exitUsage)
+		}
+	}
+	inputFormat, ok := inputFormats[cfg.inputFormat]
+	if !ok {
+		return nil, readOptions, &exitError{message: "Invalid input format", code: exitUsage,
+			args: []any{"format", cfg.inputFormat}}
+	}
+	readOptions = applymylists.ReadOptions{
+		Strict: cfg.strict, Format: inputFormat, Workers: cfg.workers, MaxDomains: cfg.maxDomains,
+		MaxDomainLength: cfg.maxDomainLength, MaxSubdomainDepth: cfg.maxSubdomainDepth, ExcludedTLDs: cfg.excludedTLDs,
+		OnlyTLDs: cfg.onlyTLDs, Since: since, HostRegexp: hostRegexp, Mmap: cfg.mmap}
+	if cfg.annotate {
+		readOptions.Source = cfg.inputPaths[0]
+	}
+	err = readOptions.Check()
+	return format, readOptions, newExitError(err, "Invalid options", exitUsage)
+}
+
+// checkInput checks whether the large blacklist, read into “domains”, looks
+// sane: It should contain domains, and not mostly of one TLD, see dominantTLD.
+// Otherwise, it logs a warning, or returns an *exitError with “cfg.strict”.
+// “cached” tells whether “domains” comes from the input cache.
+func checkInput(cfg config, domains *applymylists.Domains, cached bool) error {
+	if domains.Len() == 0 {
+		if cfg.strict {
+			return &exitError{message: "Input file contains no domains", code: exitInput,
+				args: []any{"paths", cfg.inputPaths}}
+		}
+		slog.Warn("Input file contains no domains; output will only contain the personal lists",
+			"paths", cfg.inputPaths)
+	}
+	// The domains of a cached input file are minimised already, so their
+	// distribution is meaningless.
+	if tld, share := dominantTLD(domains.TLDCounts()); tld != "" && !cached {
+		args := []any{"paths", cfg.inputPaths, "tld", tld, "share", fmt.Sprintf("%.1f%%", 100*share)}
+		if cfg.strict {
+			return &exitError{message: "Single TLD dominates the input file", code: exitInput, args: args}
+		}
+		slog.Warn("Single TLD dominates the input file; it may be malformed", args...)
+	}
+	return nil
+}
+
+// inspectInput does the work of “-count-only” and “-normalize-only”, which only
+// need the large blacklist: It reads it with “sources”, and prints its counts
+// or writes its domains in hosts format, respectively.  The personal lists are
+// not read at all.  The returned error is an *exitError.
+func inspectInput(ctx context.Context, cfg config, sources sourceReader, readOptions applymylists.ReadOptions) error {
+	domains, exceptions, err := sources.readAllDomains(ctx, cfg.inputPaths, readOptions)
+	if err := abortError(ctx); err != nil {
+		return err
+	}
+	if err != nil {
+		return newExitError(err, "Could not read domains", exitInput)
+	}
+	if err := checkInput(cfg, domains, false); err != nil {
+		return err
+	}
+	if cfg.countOnly {
+		_, err := fmt.Fprintf(cfg.stdout, "Domains: %d\nTLDs:    %d\n", domains.Len(), domains.NumberTLDs())
+		return newExitError(err, "Could not print counts", exitOutput)
+	}
+	if len(exceptions) > 0 {
+		slog.Warn("Exceptions of the input cannot be written to a hosts file; dropped",
+			"number", len(exceptions))
+	}
+	format := hostsFormat{cfg.sinkAddress}
+	options := cfg.writeOptions
+	if options.validate != nil {
+		options.validate = format
+	}
+	all := domains.All()
+	slices.Sort(all)
+	err = writeOutput(ctx, cfg.outputPath, cfg.stdout, format, nil,
+		func(yield func(tldMinimal []string) error) error {
+			return yield(all)
+		}, options)
+	return newExitError(err, "Could not write output", exitOutput)
+}
+
+// run does the actual work of the program as configured by “cfg”.  It reads
+// the large blacklist, applies the personal lists, and writes the minimal
+// domains to the output file.  The returned error is an *exitError.
+func run(ctx context.Context, cfg config) error {
+	startTime := time.Now()
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+	format, readOptions, err := checkConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if companion, ok := format.(companionFormat); ok && cfg.whitelistPath == "" {
+		if cfg.outputPath == "-" {
+			slog.Warn("Explicitly whitelisted domains are not written without -whitelist-output",
+				"format", cfg.outputFormat)
+		} else {
+			cfg.whitelistPath = companion.whitelistPath(cfg.outputPath)
+		}
+	}
+	if cfg.validateOutput {
+		// The templates are checked against the syntax of the output format.
+		cfg.writeOptions.validate = format
+	}
+	if cfg.template != "" || cfg.whitelistTemplate != "" {
+		format, err = newTemplateFormat(format, cfg.template, cfg.whitelistTemplate)
+		if err != nil {
+			return newExitError(err, "Invalid template", exitUsage)
+		}
+	}
+	sources := sourceReader{client: &http.Client{Timeout: cfg.httpTimeout}, cacheDir: cfg.cacheDir,
+		stdin: cfg.stdin, downloads: make(map[string]download)}
+	defer sources.removeDownloads()
+	if cfg.countOnly || cfg.normalizeOnly {
+		return inspectInput(ctx, cfg, sources, readOptions)
+	}
+	blacklistFiles := expandListPaths(cfg.blacklistPaths)
+	blacklists := make([][]string, len(blacklistFiles))
+	var allBlacklisted []string
+	for i, path := range blacklistFiles {
+		blacklists[i], err = sources.readList(ctx, path, readOptions)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read blacklist", exitInput, "path", path)
+		}
+		allBlacklisted = append(allBlacklisted, blacklists[i]...)
+	}
+	whitelistFiles := expandListPaths(cfg.whitelistPaths)
+	whitelists := make([][]string, len(whitelistFiles))
+	var allWhitelisted []string
+	for i, path := range whitelistFiles {
+		whitelists[i], err = sources.readList(ctx, path, readOptions)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read whitelist", exitInput, "path", path)
+		}
+		allWhitelisted = append(allWhitelisted, whitelists[i]...)
+	}
+	whitelistExactFiles := expandListPaths(cfg.whitelistExactPaths)
+	whitelistsExact := make([][]string, len(whitelistExactFiles))
+	for i, path := range whitelistExactFiles {
+		whitelistsExact[i], err = sources.readList(ctx, path, readOptions)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read whitelist", exitInput, "path", path)
+		}
+	}
+	conflicts := applymylists.Conflicts(allBlacklisted, allWhitelisted)
+	for _, entry := range conflicts {
+		slog.Warn("Domain is both on blacklist and whitelist; whitelist wins", "entry", entry)
+	}
+	if cfg.strict && len(conflicts) > 0 {
+		return &exitError{message: "Conflicting black and whitelist entries", code: exitInput,
+			args: []any{"number", len(conflicts)}}
+	}
+	cache := inputCache{dir: cfg.inputCacheDir, sources: sources}
+	var inputCacheKey string
+	if cache.dir != "" {
+		if reason := inputCacheBypass(cfg, allBlacklisted); reason != "" {
+			slog.Info("Not using the input cache", "reason", reason)
+		} else {
+			inputCacheKey, err = cache.key(ctx, cfg.inputPaths, readOptions)
+			if err := abortError(ctx); err != nil {
+				return err
+			}
+			if err != nil {
+				return newExitError(err, "Could not read domains", exitInput)
+			}
+		}
+	}
+	var domains *applymylists.Domains
+	var exceptions, cachedExplicit []string
+	var cached bool
+	if inputCacheKey != "" {
+		domains, cachedExplicit, cached, err = cache.load(ctx, inputCacheKey, readOptions)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read input cache", exitInput)
+		}
+	}
+	if !cached {
+		domains, exceptions, err = sources.readAllDomains(ctx, cfg.inputPaths, readOptions)
+	}
+	if err := abortError(ctx); err != nil {
+		return err
+	}
+	if err != nil {
+		return newExitError(err, "Could not read domains", exitInput)
+	}
+	if err := checkInput(cfg, domains, cached); err != nil {
+		return err
+	}
+	if cfg.annotate {
+		format, err = newAnnotatedFormat(format, domains.Sources)
+		if err != nil {
+			return newExitError(err, "Cannot annotate", exitUsage, "format", cfg.outputFormat)
+		}
+	}
+	if cfg.keepPath != "" {
+		patterns, err := sources.readPatterns(ctx, cfg.keepPath)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read patterns", exitInput)
+		}
+		domains.SetKeepPatterns(patterns)
+	}
+	whitelist := make(map[string]bool)
+	explicit, _, err := applymylists.ApplyWhitelist(ctx, domains, exceptions, cfg.workers,
+		slog.Default().With("paths", cfg.inputPaths))
+	if err := abortError(ctx); err != nil {
+		return err
+	}
+	if err != nil {
+		return newExitError(err, "Could not apply exceptions of input", exitInput)
+	}
+	for _, entry := range append(explicit, cachedExplicit...) {
+		whitelist[entry] = true
+	}
+	if inputCacheKey != "" && !cached {
+		err := cache.store(ctx, inputCacheKey, domains, maps.Keys(whitelist), cfg.workers)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not write input cache", exitOutput)
+		}
+		domains, _, _, err = cache.load(ctx, inputCacheKey, readOptions)
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not read input cache", exitInput)
+		}
+	}
+	var stats statistics
+	stats.DomainsRead = domains.Len()
+	stats.TLDs = domains.NumberTLDs()
+	for i, path := range blacklistFiles {
+		applymylists.ApplyBlacklist(domains, blacklists[i], path, cfg.workers, slog.Default().With("path", path))
+	}
+	var existingWhitelisted []string
+	if cfg.appendOutput {
+		var existingBlacklisted []string
+		existingBlacklisted, existingWhitelisted, err = readOutput(cfg.outputPath, format, cfg.strict)
+		if err != nil {
+			return newExitError(err, "Could not read existing output", exitInput)
+		}
+		applymylists.ApplyBlacklist(domains, existingBlacklisted, cfg.outputPath, cfg.workers,
+			slog.Default().With("path", cfg.outputPath))
+		if _, ok := format.(companionFormat); ok && cfg.whitelistPath != "" {
+			companionWhitelisted, err := sources.readList(ctx, cfg.whitelistPath, readOptions)
+			if err != nil {
+				return newExitError(err, "Could not read existing whitelist file", exitInput)
+			}
+			existingWhitelisted = append(existingWhitelisted, companionWhitelisted...)
+		}
+	}
+	if cfg.lintWhitelist {
+		redundant, orphans := applymylists.LintWhitelist(domains, allWhitelisted)
+		err := printWhitelistLint(cfg.stdout, redundant, orphans)
+		return newExitError(err, "Could not print whitelist findings", exitOutput)
+	}
+	numberBlacklisted := domains.Len()
+	stats.BlacklistAdded = numberBlacklisted - stats.DomainsRead
+	var unusedWhitelistEntries []string
+	for i, path := range whitelistFiles {
+		explicit, unused, err := applymylists.ApplyWhitelist(ctx, domains, whitelists[i], cfg.workers,
+			slog.Default().With("path", path))
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not apply whitelist", exitInput, "path", path)
+		}
+		for _, entry := range explicit {
+			whitelist[entry] = true
+		}
+		unusedWhitelistEntries = append(unusedWhitelistEntries, unused...)
+	}
+	for i, path := range whitelistExactFiles {
+		explicit, unused := applymylists.ApplyWhitelistExact(domains, whitelistsExact[i],
+			slog.Default().With("path", path))
+		for _, entry := range explicit {
+			whitelist[entry] = true
+		}
+		unusedWhitelistEntries = append(unusedWhitelistEntries, unused...)
+	}
+	if len(existingWhitelisted) > 0 {
+		explicit, _, err := applymylists.ApplyWhitelist(ctx, domains, existingWhitelisted, cfg.workers,
+			slog.Default().With("path", cfg.outputPath))
+		if err := abortError(ctx); err != nil {
+			return err
+		}
+		if err != nil {
+			return newExitError(err, "Could not merge existing output", exitInput)
+		}
+		for _, entry := range explicit {
+			whitelist[entry] = true
+		}
+	}
+	numberRemaining := domains.Len()
+	stats.WhitelistRemoved = numberBlacklisted - numberRemaining
+	stats.ExplicitWhitelist = len(whitelist)
+	slices.Sort(unusedWhitelistEntries)
+	for _, entry := range unusedWhitelistEntries {
+		slog.Info("Whitelist entry matched nothing", "entry", entry)
+	}
+	if len(unusedWhitelistEntries) > 0 {
+		slog.Warn("Some whitelist entries matched nothing", "number", len(unusedWhitelistEntries))
+	}
+	if cfg.listTLDs {
+		err := printTLDCounts(cfg.stdout, domains.TLDCounts())
+		return newExitError(err, "Could not list TLDs", exitOutput)
+	}
+	var numberChecked atomic.Int64
+	progressDone := make(chan struct{})
+	if cfg.progressInterval > 0 {
+		go reportProgress(&numberChecked, numberRemaining, cfg.progressInterval, progressDone)
+	}
+	var previous []string
+	if cfg.diffPath != "" {
+		previous, _, err = readOutput(cfg.outputPath, format, cfg.strict)
+		if err != nil {
+			close(progressDone)
+			return newExitError(err, "Could not read existing output", exitInput)
+		}
+	}
+	sortMinimal := sortOrders[cfg.sortOutput]
+	var numberMinimal int
+	// minimal collects the minimal domains only if they are needed for the
+	// diff, in order to save memory otherwise.
+	var minimal []string
+	minimize := func(yield func(tldMinimal []string) error) error {
+		return applymylists.MinimizeStream(ctx, domains, cfg.workers, &numberChecked, func(tldMinimal []string) error {
+			sortMinimal(tldMinimal)
+			numberMinimal += len(tldMinimal)
+			if cfg.diffPath != "" {
+				minimal = append(minimal, tldMinimal...)
+			}
+			return yield(tldMinimal)
+		})
+	}
+	slog.Info("Finding minimal domains", "workers", cfg.workers)
+	if cfg.dryRun {
+		err = minimize(func([]string) error { return nil })
+	} else if cfg.splitByTLD {
+		err = writeSplitOutput(ctx, cfg.outputPath, format, maps.Keys(whitelist), minimize, cfg.writeOptions)
+		if err == nil && cfg.whitelistPath != "" {
+			err = writeWhitelist(cfg.whitelistPath, maps.Keys(whitelist))
+		}
+	} else {
+		err = writeOutput(ctx, cfg.outputPath, cfg.stdout, format, maps.Keys(whitelist), minimize,
+			cfg.writeOptions)
+		if err == nil && cfg.whitelistPath != "" {
+			err = writeWhitelist(cfg.whitelistPath, maps.Keys(whitelist))
+		}
+	}
+	close(progressDone)
+	if err := abortError(ctx); err != nil {
+		return err
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return newExitError(err, "No permission to write output; run with sufficient privileges or choose "+
+			"another path with -output", exitOutput, "path", cfg.outputPath)
+	}
+	if err != nil {
+		return newExitError(err, "Could not write output", exitOutput)
+	}
+	stats.setMinimal(numberMinimal, numberRemaining)
+	slog.Info("Minimal domains collected", "number", numberMinimal, "numberBefore", numberRemaining,
+		"reduction", stats.reduction())
+	if cfg.diffPath != "" {
+		added, removed, err := writeDiff(cfg.diffPath, cfg.stdout, previous, minimal)
+		if err != nil {
+			return newExitError(err, "Could not write diff", exitOutput)
+		}
+		slog.Info("Compared with existing output", "added", len(added), "removed", len(removed))
+	}
+	stats.DurationMS = time.Since(startTime).Milliseconds()
+	if cfg.dryRun {
+		stats.print(cfg.stderr)
+	}
+	if cfg.statsJSONPath != "" {
+		if err := stats.writeJSON(cfg.statsJSONPath, cfg.stdout); err != nil {
+			return newExitError(err, "Could not write statistics", exitOutput)
+		}
+	}
+	slog.Info("Finished")
+	return nil
+}
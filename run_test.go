@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFile writes “content” to the file “name” in “dir” and returns its
+// path.
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestConfig returns the configuration main would use by default, with the
+// large blacklist “input” and the personal lists “blacklist” and “whitelist”
+// written to a temporary directory, which is returned, too.  The output goes
+// to the returned buffer.
+func newTestConfig(t *testing.T, input, blacklist, whitelist string) (cfg config, dir string, stdout *bytes.Buffer) {
+	t.Helper()
+	dir = t.TempDir()
+	stdout = new(bytes.Buffer)
+	cfg = config{
+		inputPaths:       []string{writeTestFile(t, dir, "input", input)},
+		blacklistPaths:   []string{writeTestFile(t, dir, "blacklist", blacklist)},
+		whitelistPaths:   []string{writeTestFile(t, dir, "whitelist", whitelist)},
+		outputPath:       "-",
+		workers:          2,
+		outputFormat:     "dnsmasq",
+		sortOutput:       "lexical",
+		sinkAddress:      "0.0.0.0",
+		whitelistForward: "#",
+		inputFormat:      "hosts",
+		httpTimeout:      time.Minute,
+		stdin:            strings.NewReader(""),
+		stdout:           stdout,
+		stderr:           io.Discard,
+	}
+	cfg.writeOptions.retry.attempts = 1
+	return
+}
+
+// oneTLDHosts returns a hosts file with “n” subdomains of “example.com”, enough
+// to keep the minimisation busy for a while if “n” is large.
+func oneTLDHosts(n int) string {
+	var builder strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&builder, "0.0.0.0 s%d.h%d.example.com\n", i, i/10)
+	}
+	return builder.String()
+}
+
+// checkAborted checks that “err” is an exitError with “code”, and that the
+// output file at “path” still has its old “content”.
+func checkAborted(t *testing.T, err error, code int, path, content string) {
+	t.Helper()
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != code {
+		t.Errorf("got error %v, want exit code %d", err, code)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != content {
+		t.Errorf("output file was changed to %q (%v)", got, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file was not removed: %v", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n0.0.0.0 tracker.example.org\n",
+		"evil.example.net\n", "tracker.example.org\n")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ads.example.com/\nserver=/evil.example.net/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunMultipleBlacklists(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n", "tracker.example.org\n", "")
+	cfg.blacklistPaths = append(cfg.blacklistPaths, writeTestFile(t, dir, "malware", "evil.example.net\n"))
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ads.example.com/\nserver=/evil.example.net/\nserver=/tracker.example.org/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, oneTLDHosts(50000), "", "")
+	cfg.outputPath = writeTestFile(t, dir, "output", "server=/old.example.com/\n")
+	cfg.timeout = 50 * time.Millisecond
+	start := time.Now()
+	err := run(context.Background(), cfg)
+	if duration := time.Since(start); duration > 5*time.Second {
+		t.Errorf("run took %v despite the timeout", duration)
+	}
+	checkAborted(t, err, exitTimeout, cfg.outputPath, "server=/old.example.com/\n")
+}
+
+func TestRunDeterministic(t *testing.T) {
+	input := "0.0.0.0 ads.example.com\n0.0.0.0 b.example.org\n0.0.0.0 a.example.org\n0.0.0.0 x.example.net\n" +
+		oneTLDHosts(200)
+	whitelist := "ok.ads.example.com\nfine.ads.example.com\ngood.x.example.net\n"
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		cfg, _, stdout := newTestConfig(t, input, "", whitelist)
+		cfg.workers = 4
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, stdout.String())
+	}
+	if outputs[0] != outputs[1] {
+		t.Errorf("outputs differ:\n%v\n%v", outputs[0], outputs[1])
+	}
+	if !strings.HasPrefix(outputs[0], "server=/fine.ads.example.com/#\nserver=/good.x.example.net/#\n"+
+		"server=/ok.ads.example.com/#\nserver=/ads.example.com/\n") {
+		t.Errorf("whitelisted domains not sorted before the blacklisted ones:\n%v", outputs[0])
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t, "", "", "")
+	cfg.inputPaths = []string{"-"}
+	cfg.stdin = strings.NewReader("# hosts\n0.0.0.0 ads.example.com\n127.0.0.1 x.ads.example.com\n")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunExcludeTLD(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t, "0.0.0.0 evil.gov\n0.0.0.0 evil.com\n", "ads.evil.gov\nads.example.com\n", "")
+	cfg.excludedTLDs = []string{"gov"}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/evil.com/\nserver=/ads.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunAppend(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n0.0.0.0 evil.net\n", "", "")
+	cfg.outputPath = writeTestFile(t, dir, "output",
+		"server=/ok.ads.example.com/#\nserver=/ads.example.com/\nserver=/x.evil.net/\nserver=/curated.example.org/\n")
+	cfg.appendOutput = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(cfg.outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ok.ads.example.com/#\nserver=/evil.net/\nserver=/ads.example.com/\nserver=/curated.example.org/\n"
+	if string(content) != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+}
+
+func TestRunConflicts(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n", "evil.example.org\n", "evil.example.org\n")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	cfg.strict = true
+	var exitErr *exitError
+	if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != exitInput {
+		t.Errorf("got error %v, want exit code %d in strict mode", err, exitInput)
+	}
+}
+
+func TestRunSinkAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "::"} {
+		cfg, _, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+		cfg.outputFormat = "hosts"
+		cfg.sinkAddress = address
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stdout.String(), address+" ads.example.com\n"; got != want {
+			t.Errorf("got output %q, want %q", got, want)
+		}
+	}
+	cfg, _, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+	cfg.outputFormat = "hosts"
+	cfg.sinkAddress = "localhost"
+	var exitErr *exitError
+	if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != exitUsage {
+		t.Errorf("got error %v, want exit code %d for an invalid sink address", err, exitUsage)
+	}
+}
+
+func TestRunDiff(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 new.example.com\n0.0.0.0 ads.example.com\n0.0.0.0 evil.example.org\n", "",
+		"")
+	cfg.outputPath = writeTestFile(t, dir, "output",
+		"server=/evil.example.org/\nserver=/gone.example.net/\nserver=/ads.example.com/\n")
+	cfg.diffPath = filepath.Join(dir, "diff")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(cfg.diffPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "+new.example.com\n-gone.example.net\n"; string(content) != want {
+		t.Errorf("got diff %q, want %q", content, want)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		modify func(cfg *config, dir string)
+		code   int
+	}{
+		{"missing input", func(cfg *config, dir string) { cfg.inputPaths = []string{filepath.Join(dir, "none")} },
+			exitInput},
+		{"invalid blacklist", func(cfg *config, dir string) {
+			cfg.blacklistPaths = []string{writeTestFile(t, dir, "invalid", "exa mple.com\n")}
+			cfg.strict = true
+		}, exitInput},
+		{"invalid input", func(cfg *config, dir string) {
+			cfg.inputPaths = []string{writeTestFile(t, dir, "invalid", "nonsense\n")}
+			cfg.strict = true
+		}, exitInput},
+		{"too many domains in all inputs", func(cfg *config, dir string) {
+			cfg.inputPaths = append(cfg.inputPaths, writeTestFile(t, dir, "input2", "0.0.0.0 evil.example.net\n"))
+			cfg.maxDomains = 1
+		}, exitInput},
+		{"unwritable output", func(cfg *config, dir string) {
+			cfg.outputPath = filepath.Join(dir, "none", "output")
+		}, exitOutput},
+		{"invalid output format", func(cfg *config, dir string) { cfg.outputFormat = "none" }, exitUsage},
+		{"no workers", func(cfg *config, dir string) { cfg.workers = 0 }, exitUsage},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+			test.modify(&cfg, dir)
+			var exitErr *exitError
+			if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != test.code {
+				t.Errorf("got error %v, want exit code %d", err, test.code)
+			}
+		})
+	}
+}
+
+// TestRunWhitelistExactCovered checks that a blacklisted subdomain of an exact
+// whitelist entry below a blacklisted domain stays in the output, because the
+// explicit whitelisting would unblock it otherwise.
+func TestRunWhitelistExactCovered(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t,
+		"0.0.0.0 example.com\n0.0.0.0 foo.example.com\n0.0.0.0 bad.foo.example.com\n", "", "")
+	cfg.whitelistExactPaths = []string{writeTestFile(t, dir, "whitelist-exact", "foo.example.com\n")}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/foo.example.com/#\nserver=/bad.foo.example.com/\nserver=/example.com/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunAnnotate(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n0.0.0.0 x.tracker.example.org\n",
+		"ads.example.com\ntracker.example.org\n", "")
+	cfg.inputPaths = append(cfg.inputPaths, writeTestFile(t, dir, "input2", "0.0.0.0 evil.example.net\n"))
+	cfg.annotate = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	input, input2 := filepath.Join(dir, "input"), filepath.Join(dir, "input2")
+	blacklist := filepath.Join(dir, "blacklist")
+	want := fmt.Sprintf("server=/ads.example.com/ # from %v, %v\nserver=/evil.example.net/ # from %v\n"+
+		"server=/tracker.example.org/ # from %v\n", input, blacklist, input2, blacklist)
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunWhitelistOutput(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n0.0.0.0 tracker.example.org\n", "",
+		"tracker.example.org\nok.ads.example.com\nfine.ads.example.com\n")
+	cfg.whitelistPath = filepath.Join(dir, "whitelist-output")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(cfg.whitelistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "fine.ads.example.com\nok.ads.example.com\n"; string(content) != want {
+		t.Errorf("got whitelist %q, want %q", content, want)
+	}
+	want := "server=/fine.ads.example.com/#\nserver=/ok.ads.example.com/#\nserver=/ads.example.com/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunListTLDs(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t,
+		"0.0.0.0 a.example.com\n0.0.0.0 b.example.com\n0.0.0.0 c.example.com\n0.0.0.0 x.example.org\n"+
+			"0.0.0.0 y.example.org\n0.0.0.0 evil.example.net\n0.0.0.0 ads.example.co.uk\n", "", "")
+	cfg.outputPath = filepath.Join(dir, "output")
+	cfg.listTLDs = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "3\texample.com\n2\texample.org\n1\texample.co.uk\n1\texample.net\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(cfg.outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("output file was written: %v", err)
+	}
+}
+
+func TestRunPihole(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n0.0.0.0 evil.example.org\n",
+		"", "ok.ads.example.com\n")
+	cfg.outputPath = filepath.Join(dir, "gravity.list")
+	cfg.outputFormat = "pihole"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []struct {
+		path, want string
+	}{
+		{cfg.outputPath, "ads.example.com\nevil.example.org\n"},
+		{cfg.outputPath + ".whitelist", "ok.ads.example.com\n"},
+	} {
+		content, err := os.ReadFile(file.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != file.want {
+			t.Errorf("got %q in %v, want %q", content, file.path, file.want)
+		}
+	}
+}
+
+func TestRunCountOnly(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t,
+		"0.0.0.0 a.example.com\n0.0.0.0 A.example.com\n0.0.0.0 x.a.example.com\n0.0.0.0 evil.example.org\n", "", "")
+	cfg.outputPath = filepath.Join(dir, "output")
+	cfg.countOnly = true
+	// The personal lists are not even read, so their errors do not matter.
+	cfg.blacklistPaths = []string{writeTestFile(t, dir, "invalid", "exa mple.com\n")}
+	cfg.strict = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "Domains: 3\nTLDs:    2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := os.Stat(cfg.outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("output file was written: %v", err)
+	}
+}
+
+func TestRunEmptyInput(t *testing.T) {
+	for _, test := range []struct {
+		input  string
+		strict bool
+		code   int
+	}{
+		{"# no domains\n", false, 0},
+		{"# no domains\n", true, exitInput},
+		{"0.0.0.0 ads.example.com\n", true, 0},
+	} {
+		cfg, _, stdout := newTestConfig(t, test.input, "evil.example.org\n", "")
+		cfg.strict = test.strict
+		err := run(context.Background(), cfg)
+		if test.code == 0 {
+			if err != nil {
+				t.Errorf("input %q, strict %v: %v", test.input, test.strict, err)
+			} else if !strings.Contains(stdout.String(), "server=/evil.example.org/\n") {
+				t.Errorf("input %q, strict %v: got output %q without the personal blacklist", test.input,
+					test.strict, stdout.String())
+			}
+			continue
+		}
+		var exitErr *exitError
+		if !errors.As(err, &exitErr) || exitErr.code != test.code {
+			t.Errorf("input %q, strict %v: got error %v, want exit code %d", test.input, test.strict, err, test.code)
+		}
+	}
+}
+
+func TestRunWhitelistForward(t *testing.T) {
+	for _, test := range []struct {
+		target, want string
+		code         int
+	}{
+		{"#", "server=/ok.ads.example.com/#\nserver=/ads.example.com/\n", 0},
+		{"1.1.1.1", "server=/ok.ads.example.com/1.1.1.1\nserver=/ads.example.com/\n", 0},
+		{"2606:4700::1111", "server=/ok.ads.example.com/2606:4700::1111\nserver=/ads.example.com/\n", 0},
+		{"resolver.example", "", exitUsage},
+	} {
+		cfg, _, stdout := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "ok.ads.example.com\n")
+		cfg.whitelistForward = test.target
+		err := run(context.Background(), cfg)
+		var exitErr *exitError
+		switch {
+		case test.code != 0:
+			if !errors.As(err, &exitErr) || exitErr.code != test.code {
+				t.Errorf("%v: got error %v, want exit code %d", test.target, err, test.code)
+			}
+		case err != nil:
+			t.Errorf("%v: %v", test.target, err)
+		case stdout.String() != test.want:
+			t.Errorf("%v: got output %q, want %q", test.target, stdout.String(), test.want)
+		}
+	}
+}
+
+func TestRunOnlyTLD(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n0.0.0.0 evil.example.org\n0.0.0.0 bad.example.co.uk\n",
+		"tracker.example.net\nmore.example.com\n", "")
+	cfg.onlyTLDs = []string{"com"}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\nserver=/more.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunOnlyAndExcludeTLD(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"0.0.0.0 evil.example.ru\n0.0.0.0 x.ads.ru\n0.0.0.0 ads.example.cn\n0.0.0.0 tracker.example.com\n",
+		"ads.ru\nmore.example.cn\nmore.example.com\n", "")
+	cfg.onlyTLDs = []string{"ru", "cn"}
+	cfg.excludedTLDs = []string{"ads.ru", "com"}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ads.example.cn/\nserver=/more.example.cn/\nserver=/evil.example.ru/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunValidateOutput(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+	cfg.outputPath = writeTestFile(t, dir, "output", "server=/old.example.com/\n")
+	cfg.validateOutput = true
+	cfg.template = "server=/{{.Domain}} /"
+	checkAborted(t, run(context.Background(), cfg), exitOutput, cfg.outputPath, "server=/old.example.com/\n")
+	cfg.template = "server=/{{.Domain}}/"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(cfg.outputPath); err != nil || string(content) != "server=/ads.example.com/\n" {
+		t.Errorf("got output %q (%v) with a valid template", content, err)
+	}
+}
+
+func TestRunSplitByTLD(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t,
+		"0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n0.0.0.0 evil.example.org\n0.0.0.0 bad.example.co.uk\n",
+		"tracker.example.net\n", "ok.ads.example.com\n")
+	cfg.outputPath = filepath.Join(dir, "servers-blacklist")
+	cfg.splitByTLD = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("got output %q on stdout", stdout)
+	}
+	for _, file := range []struct {
+		tld, want string
+	}{
+		{"com", "server=/ok.ads.example.com/#\nserver=/ads.example.com/\n"},
+		{"net", "server=/tracker.example.net/\n"},
+		{"org", "server=/evil.example.org/\n"},
+		{"uk", "server=/bad.example.co.uk/\n"},
+	} {
+		content, err := os.ReadFile(cfg.outputPath + "." + file.tld)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != file.want {
+			t.Errorf("got %q for %v, want %q", content, file.tld, file.want)
+		}
+	}
+	if _, err := os.Stat(cfg.outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unsplit output file was written: %v", err)
+	}
+}
+
+func TestRunNormalizeOnly(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"# messy list\n0.0.0.0 Evil.Example.ORG\n127.0.0.1\tads.example.com  # ads\n0.0.0.0 x.ads.example.com\n\n"+
+			"0.0.0.0 ads.example.com\n0.0.0.0 bücher.example.net\n0.0.0.0 EVIL.example.org\n",
+		"tracker.example.net\n", "ads.example.com\n")
+	cfg.normalizeOnly = true
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "0.0.0.0 ads.example.com\n0.0.0.0 evil.example.org\n0.0.0.0 x.ads.example.com\n" +
+		"0.0.0.0 xn--bcher-kva.example.net\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestRunSince(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"0.0.0.0 old.example.com # 2024-05-31\n0.0.0.0 new.example.com # 2024-06-01\n0.0.0.0 undated.example.org\n",
+		"", "")
+	cfg.since = "2024-06-01"
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/new.example.com/\nserver=/undated.example.org/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	cfg.since = "06/01/2024"
+	var exitErr *exitError
+	if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != exitUsage {
+		t.Errorf("got error %v for an invalid date, want exit code %d", err, exitUsage)
+	}
+}
+
+func TestRunHostRegexp(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t, "10.0.0.1\tads.example.com\n10.0.0.1\tx.ads.example.com\n", "", "")
+	cfg.hostRegexp = `^10\.0\.0\.1\t+(\S+)$`
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+	for _, expr := range []string{`^10\.0\.0\.1\t+\S+$`, `^10\.0\.0\.1\t+(\S+$`} {
+		cfg.hostRegexp = expr
+		var exitErr *exitError
+		if err := run(context.Background(), cfg); !errors.As(err, &exitErr) || exitErr.code != exitUsage {
+			t.Errorf("%v: got error %v, want exit code %d", expr, err, exitUsage)
+		}
+	}
+}
+
+// TestRunInsertionOrder checks that the shortest covering domain wins, no
+// matter whether it comes from the input file or from the personal blacklist.
+func TestRunInsertionOrder(t *testing.T) {
+	longer := "ads.example.com\nx.ads.example.com\na.b.evil.example.org\n"
+	shorter := "example.com\nevil.example.org\n"
+	for _, test := range []struct {
+		name             string
+		input, blacklist string
+	}{
+		{"main list then blacklist", longer, shorter},
+		{"blacklist then main list", shorter, longer},
+	} {
+		cfg, _, stdout := newTestConfig(t, test.input, test.blacklist, "")
+		cfg.inputFormat = "plain"
+		if err := run(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stdout.String(), "server=/example.com/\nserver=/evil.example.org/\n"; got != want {
+			t.Errorf("%v: got output %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+// TestRunWhitelistMiddle whitelists domains in the middle of chains of
+// subdomains and checks that no leftover subdomain of another written domain
+// ends up in the output.
+func TestRunWhitelistMiddle(t *testing.T) {
+	cfg, _, stdout := newTestConfig(t,
+		"0.0.0.0 a.b.example.com\n0.0.0.0 x.a.b.example.com\n0.0.0.0 c.b.example.com\n"+
+			"0.0.0.0 y.c.b.example.com\n0.0.0.0 z.y.c.b.example.com\n0.0.0.0 s.example.org\n"+
+			"0.0.0.0 x.s.example.org\n0.0.0.0 l.o.n.g.example.org\n0.0.0.0 o.n.g.example.org\n",
+		"", "a.b.example.com\ns.example.org\n")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/c.b.example.com/\nserver=/o.n.g.example.org/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRunSignal sends SIGINT to the process while run is minimising, with the
+// same signal handling as in main.
+func TestRunSignal(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t, oneTLDHosts(50000), "", "")
+	cfg.outputPath = writeTestFile(t, dir, "output", "server=/old.example.com/\n")
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	timer := time.AfterFunc(50*time.Millisecond, func() {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	})
+	defer timer.Stop()
+	err := run(ctx, cfg)
+	checkAborted(t, err, exitInterrupted, cfg.outputPath, "server=/old.example.com/\n")
+}
+
+// TestRunPermissionDenied writes the output to a read-only directory.  Root may
+// write there nevertheless, so the test is skipped for root.
+func TestRunPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores file permissions")
+	}
+	cfg, dir, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "", "")
+	outputDir := filepath.Join(dir, "readonly")
+	if err := os.Mkdir(outputDir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	cfg.outputPath = filepath.Join(outputDir, "servers-blacklist")
+	err := run(context.Background(), cfg)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != exitOutput {
+		t.Fatalf("got error %v, want exit code %d", err, exitOutput)
+	}
+	if !errors.Is(err, syscall.EACCES) {
+		t.Errorf("got error %v, want EACCES", err)
+	}
+	if !strings.Contains(exitErr.message, "-output") {
+		t.Errorf("got message %q, want a hint at -output", exitErr.message)
+	}
+	if _, err := os.Stat(cfg.outputPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("output file was written: %v", err)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+	"go4.org/must"
+)
+
+// sourceReader opens and reads the input files given on the command line,
+// which may also be URLs or stdin.
+type sourceReader struct {
+	// client is used for downloading lists given as URLs.
+	client *http.Client
+	// cacheDir is the directory in which downloaded lists are cached.  If it
+	// is empty, nothing is cached.
+	cacheDir string
+	// stdin is read for the path “-”.
+	stdin io.Reader
+	// downloads maps URLs which have been downloaded already to local copies
+	// of their content, which open uses instead of downloading them again.
+	// It is filled by inputCache.hashFile.  If it is nil, nothing is recorded.
+	downloads map[string]download
+}
+
+// download is a local copy of a downloaded list, see sourceReader.downloads.
+type download struct {
+	// path is the path of the local copy.
+	path string
+	// temporary tells whether the copy must be removed after use, as opposed
+	// to a file of the download cache.
+	temporary bool
+}
+
+// cacheMetadata holds the HTTP validators of a cached download.  It is stored
+// as JSON next to the cached body.
+type cacheMetadata struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// inputSource is a kind of input other than a file, stdin, or a URL, e.g. a
+// database.  Its content is a list of domains, one per line, so that it is read
+// like a personal list, and in the plain format for the large blacklist.
+type inputSource interface {
+	// matches returns whether “path” denotes an input of this kind.
+	matches(path string) bool
+	// open returns the domains of the input at “path”, one per line.
+	open(ctx context.Context, path string) (io.ReadCloser, error)
+}
+
+// inputSources are the kinds of inputs which open tries before treating a path
+// as a file.
+var inputSources = []inputSource{sqliteSource{}}
+
+// findInputSource returns the input source “path” denotes, or nil if it is a
+// file, stdin, or a URL.
+func findInputSource(path string) inputSource {
+	for _, source := range inputSources {
+		if source.matches(path) {
+			return source
+		}
+	}
+	return nil
+}
+
+// isURL returns whether “path” is an HTTP(S) URL rather than a file path.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// open opens the file at “path” for reading.  If “path” is “-”, stdin is
+// returned; closing it is a no-op.  If it denotes one of the inputSources, the
+// source is opened instead.  If “path” is an HTTP or HTTPS URL, the
+// resource is downloaded instead, and the response body is returned.  Any
+// status code other than 200 is an error.  If “cacheDir” is set, downloads go
+// through the cache, see openCached.  URLs in “downloads” are not downloaded
+// again.  Downloads are aborted if “ctx” is cancelled.
+func (s sourceReader) open(ctx context.Context, path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(s.stdin), nil
+	}
+	if source := findInputSource(path); source != nil {
+		return source.open(ctx, path)
+	}
+	if !isURL(path) {
+		return os.Open(path)
+	}
+	if local, ok := s.downloads[path]; ok {
+		return os.Open(local.path)
+	}
+	if s.cacheDir != "" {
+		return s.openCached(ctx, path)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download “%v”: %w", path, err)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download “%v”: %w", path, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("Could not download “%v”: %v", path, response.Status)
+	}
+	return response.Body, nil
+}
+
+// openCached downloads the resource at “url” into “cacheDir” and opens the
+// cached copy.  If there already is a cached copy, the download is
+// conditional, using the “ETag” and “Last-Modified” headers of the previous
+// download.  If the server answers with 304, the cached copy is used as is.
+// The cache files are named after the SHA-256 of the URL.
+func (s sourceReader) openCached(ctx context.Context, url string) (io.ReadCloser, error) {
+	bodyPath := filepath.Join(s.cacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+	metadataPath := bodyPath + ".json"
+	var metadata cacheMetadata
+	if _, err := os.Stat(bodyPath); err == nil {
+		if data, err := os.ReadFile(metadataPath); err == nil {
+			if err := json.Unmarshal(data, &metadata); err != nil {
+				slog.Warn("Ignoring invalid cache metadata", "path", metadataPath, "error", err)
+				metadata = cacheMetadata{}
+			}
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download “%v”: %w", url, err)
+	}
+	if metadata.ETag != "" {
+		request.Header.Set("If-None-Match", metadata.ETag)
+	}
+	if metadata.LastModified != "" {
+		request.Header.Set("If-Modified-Since", metadata.LastModified)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("Could not download “%v”: %w", url, err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		slog.Info("Using cached copy", "url", url, "path", bodyPath)
+		return os.Open(bodyPath)
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("Could not download “%v”: %v", url, response.Status)
+	}
+	if err := os.MkdirAll(s.cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("Could not create cache directory “%v”: %w", s.cacheDir, err)
+	}
+	tmpFile, err := os.CreateTemp(s.cacheDir, filepath.Base(bodyPath)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Could not create cache file: %w", err)
+	}
+	_, err = io.Copy(tmpFile, response.Body)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), bodyPath)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return nil, fmt.Errorf("Could not download “%v” into cache: %w", url, err)
+	}
+	metadata = cacheMetadata{url, response.Header.Get("ETag"), response.Header.Get("Last-Modified")}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(metadataPath, data, 0644); err != nil {
+		return nil, fmt.Errorf("Could not write cache metadata “%v”: %w", metadataPath, err)
+	}
+	slog.Info("Refreshed cached copy", "url", url, "path", bodyPath)
+	return os.Open(bodyPath)
+}
+
+// removeDownloads removes the temporary local copies of downloaded lists, see
+// sourceReader.downloads.
+func (s sourceReader) removeDownloads() {
+	for _, local := range s.downloads {
+		if local.temporary {
+			os.Remove(local.path)
+		}
+	}
+}
+
+// readList reads the black or whitelist at “path”, which may also be an
+// HTTP(S) URL or “-” for stdin, see applymylists.ReadList.  A missing file is
+// treated as an empty list.
+func (s sourceReader) readList(ctx context.Context, path string, options applymylists.ReadOptions) ([]string, error) {
+	f, err := s.open(ctx, path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Could not find file; assumed empty", "path", path)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Could not open list file “%v”: %w", path, err)
+	}
+	defer must.Close(f)
+	entries, err := applymylists.ReadList(f, options, slog.Default().With("path", path))
+	if err != nil {
+		return nil, listError(path, err)
+	}
+	return entries, nil
+}
+
+// listError wraps “err”, returned when reading the file at “path”, in an
+// applymylists.ListError, so that callers can find out the path with
+// errors.As.  The file of a contained applymylists.ParseError is set, too.
+func listError(path string, err error) error {
+	var parseErr *applymylists.ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.File = path
+	}
+	return &applymylists.ListError{Path: path, Err: err}
+}
+
+// readDomains reads the large blacklist file at “path”, which may also be an
+// HTTP(S) URL or “-” for stdin, see applymylists.ReadDomains.  If the file is
+// gzip-compressed, it is decompressed transparently.  If it is a tar archive,
+// its text files are read one after the other, see archiveReader.  If
+// “options.Mmap” is true, a local file is passed unread to
+// applymylists.ReadDomains, so that it can be mapped into memory, unless it is
+// compressed or an archive.  One of the inputSources is always read in the
+// plain format.
+func (s sourceReader) readDomains(ctx context.Context, path string, options applymylists.ReadOptions) (
+	domains *applymylists.Domains, exceptions []string, err error) {
+	slog.Info("Reading domains", "path", path)
+	if findInputSource(path) != nil {
+		options.Format = applymylists.FormatPlain
+	}
+	f, err := s.open(ctx, path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not open domains file “%v”: %w", path, err)
+	}
+	defer must.Close(f)
+	var r io.Reader
+	if file, ok := f.(*os.File); ok && options.Mmap && isMappable(file) {
+		r = file
+	} else {
+		bufferedFile := bufio.NewReader(f)
+		r = bufferedFile
+		if magic, _ := bufferedFile.Peek(2); isGzip(magic) {
+			gz, err := gzip.NewReader(bufferedFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not decompress domains file “%v”: %w", path, err)
+			}
+			defer must.Close(gz)
+			r = gz
+		}
+		bufferedData := bufio.NewReader(r)
+		r = bufferedData
+		if start, _ := bufferedData.Peek(tarMagicEnd); isTar(start) {
+			r = &archiveReader{archive: tar.NewReader(bufferedData), path: path}
+		}
+	}
+	domains, exceptions, err = applymylists.ReadDomains(ctx, r, options, slog.Default())
+	if err != nil && ctx.Err() == nil {
+		return nil, nil, listError(path, err)
+	}
+	return
+}
+
+// readAllDomains reads the large blacklist files at “paths” with readDomains
+// and merges their domains and exceptions.  Domains contained in several files
+// are counted only once.  If sources are tracked, i.e. “options.Source” is not
+// empty, every file is recorded as the source of its domains.
+// “options.MaxDomains” limits the number of domains read from all files
+// together.
+func (s sourceReader) readAllDomains(ctx context.Context, paths []string, options applymylists.ReadOptions) (
+	domains *applymylists.Domains, exceptions []string, err error) {
+	if options.DomainCount == nil {
+		options.DomainCount = new(atomic.Int64)
+	}
+	for _, path := range paths {
+		if options.Source != "" {
+			options.Source = path
+		}
+		fileDomains, fileExceptions, err := s.readDomains(ctx, path, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		exceptions = append(exceptions, fileExceptions...)
+		if domains == nil {
+			domains = fileDomains
+			continue
+		}
+		number := fileDomains.Len()
+		numberNew := domains.Merge(fileDomains)
+		slog.Info("Merged domains file", "path", path, "number", number, "numberNew", numberNew)
+	}
+	if len(paths) > 1 {
+		slog.Info("Finished merging domains files", "number", domains.Len(), "numberTLDs", domains.NumberTLDs(),
+			"numberExceptions", len(exceptions))
+	}
+	return
+}
+
+// isMappable returns whether “f” can be mapped into memory by
+// applymylists.ReadDomains.  This is not the case for gzip-compressed files, tar
+// archives, and files which cannot be read at arbitrary offsets, like pipes.  It
+// does not change the offset of “f”.
+func isMappable(f *os.File) bool {
+	var start [tarMagicEnd]byte
+	n, err := f.ReadAt(start[:], 0)
+	if n == 0 || err != nil && !errors.Is(err, io.EOF) {
+		return false
+	}
+	return !isGzip(start[:n]) && !isTar(start[:n])
+}
+
+// isGzip returns whether “start”, the beginning of a file, is the one of gzip
+// data.
+func isGzip(start []byte) bool {
+	return len(start) >= 2 && start[0] == 0x1f && start[1] == 0x8b
+}
+
+// tarMagicEnd is the offset of the end of the magic string “ustar” in a tar
+// archive.
+const tarMagicEnd = 262
+
+// isTar returns whether “start”, the beginning of a file, is the one of a tar
+// archive.
+func isTar(start []byte) bool {
+	return len(start) >= tarMagicEnd && string(start[tarMagicEnd-5:tarMagicEnd]) == "ustar"
+}
+
+// archiveReader reads the regular files in a tar archive one after the other,
+// as if they were one file.  A newline is inserted after a file not ending in
+// one.  Files containing NUL bytes in their first 512 bytes are considered
+// binary and skipped with a warning.  Since the files are read as one, line
+// numbers in messages count across all of them.
+type archiveReader struct {
+	archive *tar.Reader
+	// path is the path of the archive, used in log messages.
+	path string
+	// member is the file currently read, or nil if the next one must be
+	// looked for.
+	member *bufio.Reader
+	// lastByte is the last byte returned, or 0 if nothing was returned yet.
+	lastByte byte
+}
+
+func (a *archiveReader) Read(p []byte) (int, error) {
+	for {
+		if a.member != nil {
+			n, err := a.member.Read(p)
+			if n > 0 {
+				a.lastByte = p[n-1]
+				return n, nil
+			}
+			if err != io.EOF {
+				return 0, err
+			}
+			a.member = nil
+			if a.lastByte != 0 && a.lastByte != '\n' && len(p) > 0 {
+				p[0] = '\n'
+				a.lastByte = '\n'
+				return 1, nil
+			}
+		}
+		header, err := a.archive.Next()
+		if err != nil {
+			return 0, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		member := bufio.NewReader(a.archive)
+		if start, _ := member.Peek(512); bytes.IndexByte(start, 0) >= 0 {
+			slog.Warn("Skipping binary file in archive", "path", a.path, "member", header.Name)
+			continue
+		}
+		slog.Info("Reading file in archive", "path", a.path, "member", header.Name)
+		a.member = member
+	}
+}
+
+// readPatterns reads the regular expressions in the file at “path”, which may
+// also be an HTTP(S) URL or “-” for stdin, see applymylists.ReadPatterns.
+func (s sourceReader) readPatterns(ctx context.Context, path string) ([]*regexp.Regexp, error) {
+	f, err := s.open(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open patterns file “%v”: %w", path, err)
+	}
+	defer must.Close(f)
+	patterns, err := applymylists.ReadPatterns(f)
+	if err != nil {
+		return nil, listError(path, err)
+	}
+	return patterns, nil
+}
+
+// expandListPaths expands the paths of personal lists given on the command
+// line.  A directory is replaced by the regular files in it, except for hidden
+// ones, in lexical order.  A path containing glob meta characters is replaced
+// by the matching files, see filepath.Glob.  Files found this way which cannot
+// be opened, as well as globs matching nothing, are skipped with a warning.
+// All other paths, including URLs, “-”, and those of the inputSources, are
+// returned unchanged.
+func expandListPaths(paths []string) (expanded []string) {
+	for _, path := range paths {
+		if path == "-" || isURL(path) || findInputSource(path) != nil {
+			expanded = append(expanded, path)
+			continue
+		}
+		var candidates []string
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				slog.Warn("Could not read directory; skipped", "path", path, "error", err)
+				continue
+			}
+			for _, entry := range entries {
+				if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+					candidates = append(candidates, filepath.Join(path, entry.Name()))
+				}
+			}
+		} else if strings.ContainsAny(path, "*?[") {
+			candidates, err = filepath.Glob(path)
+			if err != nil {
+				slog.Warn("Invalid glob pattern; skipped", "pattern", path, "error", err)
+				continue
+			}
+			if len(candidates) == 0 {
+				slog.Warn("Glob pattern matched no files", "pattern", path)
+			}
+		} else {
+			expanded = append(expanded, path)
+			continue
+		}
+		for _, candidate := range candidates {
+			f, err := os.Open(candidate)
+			if err != nil {
+				slog.Warn("Could not open list file; skipped", "path", candidate, "error", err)
+				continue
+			}
+			f.Close()
+			expanded = append(expanded, candidate)
+		}
+	}
+	return
+}
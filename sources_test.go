@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+)
+
+// gzipped returns “content” gzip-compressed.
+func gzipped(t *testing.T, content string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	if _, err := gz.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestReadDomainsGzip(t *testing.T) {
+	hosts := "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com\n127.0.0.1 evil.example.org\n"
+	dir := t.TempDir()
+	plainPath := writeTestFile(t, dir, "hosts", hosts)
+	gzipPath := writeTestFile(t, dir, "hosts.gz", gzipped(t, hosts))
+	var sources sourceReader
+	plain, _, err := sources.readDomains(context.Background(), plainPath, applymylists.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, _, err := sources.readDomains(context.Background(), gzipPath, applymylists.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed.Len() != 3 || compressed.Len() != plain.Len() {
+		t.Errorf("got %d domains from the compressed file, want %d", compressed.Len(), plain.Len())
+	}
+}
+
+// tarball returns a tar archive with the files “members”, each a pair of name
+// and content.  Names ending in a slash become directories.
+func tarball(t *testing.T, members ...[2]string) string {
+	t.Helper()
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	for _, member := range members {
+		header := &tar.Header{Name: member[0], Mode: 0o644, Size: int64(len(member[1])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(member[0], "/") {
+			header.Typeflag, header.Mode = tar.TypeDir, 0o755
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(member[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestReadDomainsTarGz(t *testing.T) {
+	archive := tarball(t,
+		[2]string{"lists/", ""},
+		[2]string{"lists/ads", "0.0.0.0 ads.example.com\n0.0.0.0 x.ads.example.com"},
+		[2]string{"lists/logo.png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"},
+		[2]string{"lists/malware", "127.0.0.1 evil.example.org\n"})
+	path := writeTestFile(t, t.TempDir(), "lists.tar.gz", gzipped(t, archive))
+	var sources sourceReader
+	domains, _, err := sources.readDomains(context.Background(), path, applymylists.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := domains.All()
+	slices.Sort(all)
+	if want := []string{"ads.example.com", "evil.example.org", "x.ads.example.com"}; !slices.Equal(all, want) {
+		t.Errorf("got %q, want %q", all, want)
+	}
+}
+
+func TestReadAllDomains(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{
+		writeTestFile(t, dir, "first", "0.0.0.0 ads.example.com\n0.0.0.0 evil.example.org\n0.0.0.0 a.example.net\n"),
+		writeTestFile(t, dir, "second", "0.0.0.0 evil.example.org\n0.0.0.0 ADS.example.com\n0.0.0.0 b.example.net\n"),
+	}
+	var sources sourceReader
+	domains, _, err := sources.readAllDomains(context.Background(), paths, applymylists.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := domains.All()
+	slices.Sort(all)
+	want := []string{"a.example.net", "ads.example.com", "b.example.net", "evil.example.org"}
+	if !slices.Equal(all, want) {
+		t.Errorf("got %q, want %q", all, want)
+	}
+	if domains.Len() != len(want) {
+		t.Errorf("got %d domains, want %d", domains.Len(), len(want))
+	}
+}
+
+func TestReadAllDomainsMaxDomains(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{
+		writeTestFile(t, dir, "first", "0.0.0.0 ads.example.com\n0.0.0.0 evil.example.org\n"),
+		writeTestFile(t, dir, "second", "0.0.0.0 a.example.net\n0.0.0.0 b.example.net\n"),
+	}
+	var sources sourceReader
+	_, _, err := sources.readAllDomains(context.Background(), paths, applymylists.ReadOptions{MaxDomains: 3})
+	if !errors.Is(err, applymylists.ErrTooManyDomains) {
+		t.Errorf("got error %v, want %v", err, applymylists.ErrTooManyDomains)
+	}
+	domains, _, err := sources.readAllDomains(context.Background(), paths, applymylists.ReadOptions{MaxDomains: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := domains.Len(); got != 4 {
+		t.Errorf("got %d domains, want 4", got)
+	}
+}
+
+func TestReadDomainsURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hosts" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "0.0.0.0 ads.example.com\n0.0.0.0 evil.example.org\n")
+	}))
+	defer server.Close()
+	sources := sourceReader{client: server.Client()}
+	domains, _, err := sources.readDomains(context.Background(), server.URL+"/hosts", applymylists.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domains.Len() != 2 {
+		t.Errorf("got %d domains, want 2", domains.Len())
+	}
+	if _, _, err := sources.readDomains(context.Background(), server.URL+"/missing",
+		applymylists.ReadOptions{}); err == nil {
+		t.Error("status 404 did not fail")
+	}
+}
+
+func TestOpenCached(t *testing.T) {
+	body, etag := "0.0.0.0 ads.example.com\n", `"v1"`
+	var numberFull, numberNotModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			numberNotModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		numberFull++
+		w.Header().Set("ETag", etag)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+	sources := sourceReader{client: server.Client(), cacheDir: t.TempDir()}
+	read := func() string {
+		t.Helper()
+		f, err := sources.open(context.Background(), server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		content, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	if got := read(); got != body {
+		t.Errorf("first download: got %q, want %q", got, body)
+	}
+	if got := read(); got != body || numberFull != 1 || numberNotModified != 1 {
+		t.Errorf("cache hit: got %q after %d full and %d conditional answers", got, numberFull, numberNotModified)
+	}
+	body, etag = "0.0.0.0 evil.example.org\n", `"v2"`
+	if got := read(); got != body || numberFull != 2 {
+		t.Errorf("cache refresh: got %q after %d full answers", got, numberFull)
+	}
+	if got := read(); got != body || numberNotModified != 2 {
+		t.Errorf("refreshed cache hit: got %q after %d conditional answers", got, numberNotModified)
+	}
+}
+
+func TestExpandListPaths(t *testing.T) {
+	dir := t.TempDir()
+	first := writeTestFile(t, dir, "a.list", "ads.example.com\n")
+	second := writeTestFile(t, dir, "b.list", "evil.example.org\n")
+	writeTestFile(t, dir, "notes.txt", "")
+	writeTestFile(t, dir, ".hidden", "")
+	want := []string{first, second}
+	if got := expandListPaths([]string{filepath.Join(dir, "*.list")}); !slices.Equal(got, want) {
+		t.Errorf("glob: got %q, want %q", got, want)
+	}
+	database := filepath.Join(dir, "lists.db") + "?table=domains&column=fqdn"
+	want = []string{first, second, filepath.Join(dir, "notes.txt"), "-", database}
+	if got := expandListPaths([]string{dir, filepath.Join(dir, "*.none"), "-", database}); !slices.Equal(got, want) {
+		t.Errorf("directory: got %q, want %q", got, want)
+	}
+}
+
+func TestRunBlacklistGlob(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "", "", "")
+	listDir := filepath.Join(dir, "blocklists.d")
+	if err := os.Mkdir(listDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, listDir, "ads.list", "ads.example.com\n")
+	writeTestFile(t, listDir, "malware.list", "evil.example.org\n")
+	cfg.blacklistPaths = []string{filepath.Join(listDir, "*.list")}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "server=/ads.example.com/\nserver=/evil.example.org/\n"; got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestReadListErrors(t *testing.T) {
+	dir := t.TempDir()
+	options := applymylists.ReadOptions{Strict: true}
+	var sources sourceReader
+	listPath := writeTestFile(t, dir, "blacklist", "good.example.com\nexa mple.com\n")
+	_, listErr := sources.readList(context.Background(), listPath, options)
+	domainsPath := writeTestFile(t, dir, "hosts", "0.0.0.0 good.example.com\n0.0.0.0 example..com\n")
+	_, _, domainsErr := sources.readDomains(context.Background(), domainsPath, options)
+	for _, test := range []struct {
+		err           error
+		path, content string
+	}{
+		{listErr, listPath, "exa mple.com"},
+		{domainsErr, domainsPath, "0.0.0.0 example..com"},
+	} {
+		var pathErr *applymylists.ListError
+		if !errors.As(test.err, &pathErr) || pathErr.Path != test.path {
+			t.Errorf("got error %v, want a ListError for %v", test.err, test.path)
+		}
+		var parseErr *applymylists.ParseError
+		if !errors.As(test.err, &parseErr) {
+			t.Errorf("got error %v, want a ParseError", test.err)
+		} else if parseErr.File != test.path || parseErr.Line != 2 || parseErr.Content != test.content {
+			t.Errorf("got ParseError in %v, line %d, %q, want %v, 2, %q", parseErr.File, parseErr.Line,
+				parseErr.Content, test.path, test.content)
+		}
+	}
+}
+
+// TestRunBlacklistError checks that the typed errors of an invalid blacklist
+// survive up to the result of run.
+func TestRunBlacklistError(t *testing.T) {
+	cfg, _, _ := newTestConfig(t, "0.0.0.0 ads.example.com\n", "evil.example.org\nexa mple.com\n", "")
+	cfg.strict = true
+	err := run(context.Background(), cfg)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != exitInput {
+		t.Errorf("got error %v, want exit code %d", err, exitInput)
+	}
+	var listErr *applymylists.ListError
+	if !errors.As(err, &listErr) || listErr.Path != cfg.blacklistPaths[0] {
+		t.Errorf("got error %v, want a ListError for the blacklist", err)
+	}
+	var parseErr *applymylists.ParseError
+	if !errors.As(err, &parseErr) || parseErr.File != cfg.blacklistPaths[0] || parseErr.Line != 2 {
+		t.Errorf("got error %v, want a ParseError in line 2 of the blacklist", err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSource is the input source reading the domains from a column of a
+// table in an SQLite database.  Its paths have the form
+// “file.db?table=domains&column=fqdn”, i.e. the path of the database file with
+// the names of the table and the column as query parameters.  Further query
+// parameters are passed to the driver, see parseSQLitePath.  NULL values are
+// skipped.
+type sqliteSource struct{}
+
+// parseSQLitePath splits “path” into the data source name for the SQLite
+// driver and the names of the table and the column.  The data source name is
+// the part of “path” before the “?”, followed by the query parameters other
+// than “table” and “column”.  This way, e.g.
+// “file:name?mode=memory&cache=shared&table=domains&column=fqdn” addresses a
+// shared in-memory database.  “ok” is false if “path” is no database path at
+// all, i.e. a URL or a path without the “table” parameter.
+func parseSQLitePath(path string) (dataSourceName, table, column string, ok bool) {
+	if isURL(path) {
+		return "", "", "", false
+	}
+	name, query, found := strings.Cut(path, "?")
+	if !found {
+		return "", "", "", false
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil || !values.Has("table") {
+		return "", "", "", false
+	}
+	table, column = values.Get("table"), values.Get("column")
+	values.Del("table")
+	values.Del("column")
+	dataSourceName = name
+	if len(values) > 0 {
+		dataSourceName += "?" + values.Encode()
+	}
+	return dataSourceName, table, column, true
+}
+
+func (sqliteSource) matches(path string) bool {
+	_, _, _, ok := parseSQLitePath(path)
+	return ok
+}
+
+// quoteIdentifier returns “name” as a quoted SQL identifier, so that it can be
+// used safely in a query.  It uses backticks rather than double quotes, because
+// SQLite treats an unknown identifier in double quotes as a string, which would
+// turn a misspelt column name into a domain.
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// open queries the column of the table given in “path”.  The rows are written
+// to the returned reader by a goroutine while they are fetched, so that a large
+// table is never held in memory as a whole.  A database file which does not
+// exist is an error wrapping os.ErrNotExist rather than being created.
+func (sqliteSource) open(ctx context.Context, path string) (io.ReadCloser, error) {
+	dataSourceName, table, column, _ := parseSQLitePath(path)
+	if table == "" || column == "" {
+		return nil, fmt.Errorf("Database path “%v” needs both a table and a column", path)
+	}
+	if !strings.HasPrefix(dataSourceName, "file:") {
+		if _, err := os.Stat(dataSourceName); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open database “%v”: %w", dataSourceName, err)
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+quoteIdentifier(column)+" FROM "+quoteIdentifier(table))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Could not query database “%v”: %w", dataSourceName, err)
+	}
+	r, w := io.Pipe()
+	go func() {
+		defer db.Close()
+		defer rows.Close()
+		if err := writeRows(rows, w); err != nil {
+			w.CloseWithError(fmt.Errorf("Could not read database “%v”: %w", dataSourceName, err))
+		} else {
+			w.Close()
+		}
+	}()
+	return r, nil
+}
+
+// writeRows writes the values of the single column of “rows” to “w”, one per
+// line.  NULL values are skipped.  It stops as soon as writing fails, e.g.
+// because the reader was closed.
+func writeRows(rows *sql.Rows, w io.Writer) error {
+	bufferedWriter := bufio.NewWriter(w)
+	for rows.Next() {
+		var domain sql.NullString
+		if err := rows.Scan(&domain); err != nil {
+			return err
+		}
+		if !domain.Valid {
+			continue
+		}
+		if _, err := bufferedWriter.WriteString(domain.String + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bufferedWriter.Flush()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+)
+
+// openTestDatabase creates the shared in-memory database “name” with a table
+// “domains” containing “values” in its column “fqdn”.  The database exists as
+// long as the returned connection is open.
+func openTestDatabase(t *testing.T, name string, values ...any) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE domains (id INTEGER PRIMARY KEY, fqdn TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range values {
+		if _, err := db.Exec(`INSERT INTO domains (fqdn) VALUES (?)`, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestReadDomainsSQLite(t *testing.T) {
+	openTestDatabase(t, "readdomains", "ads.example.com", "Evil.Example.ORG", nil, "x.ads.example.com")
+	var sources sourceReader
+	path := "file:readdomains?mode=memory&cache=shared&table=domains&column=fqdn"
+	domains, _, err := sources.readDomains(context.Background(), path,
+		applymylists.ReadOptions{Format: applymylists.FormatHosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := domains.All()
+	slices.Sort(all)
+	if want := []string{"ads.example.com", "evil.example.org", "x.ads.example.com"}; !slices.Equal(all, want) {
+		t.Errorf("got %q, want %q", all, want)
+	}
+}
+
+func TestRunSQLiteInput(t *testing.T) {
+	cfg, dir, stdout := newTestConfig(t, "", "evil.example.net\n", "")
+	dbPath := filepath.Join(dir, "file.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE domains (fqdn TEXT);
+		INSERT INTO domains VALUES ('ads.example.com'), ('x.ads.example.com'), ('tracker.example.org')`); err != nil {
+		t.Fatal(err)
+	}
+	cfg.inputPaths = []string{dbPath + "?table=domains&column=fqdn"}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := "server=/ads.example.com/\nserver=/evil.example.net/\nserver=/tracker.example.org/\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestParseSQLitePath(t *testing.T) {
+	for _, test := range []struct {
+		path, dataSourceName, table, column string
+		ok                                  bool
+	}{
+		{"file.db?table=domains&column=fqdn", "file.db", "domains", "fqdn", true},
+		{"file:name?mode=memory&table=domains&column=fqdn", "file:name?mode=memory", "domains", "fqdn", true},
+		{"file.db?table=domains", "file.db", "domains", "", true},
+		{"file.db", "", "", "", false},
+		{"what?.txt", "", "", "", false},
+		{"https://example.com/list?table=domains&column=fqdn", "", "", "", false},
+	} {
+		dataSourceName, table, column, ok := parseSQLitePath(test.path)
+		if dataSourceName != test.dataSourceName || table != test.table || column != test.column || ok != test.ok {
+			t.Errorf("parseSQLitePath(%q) = %q, %q, %q, %v, want %q, %q, %q, %v", test.path, dataSourceName, table,
+				column, ok, test.dataSourceName, test.table, test.column, test.ok)
+		}
+	}
+}
+
+func TestSQLiteSourceErrors(t *testing.T) {
+	openTestDatabase(t, "errors")
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.db")
+	var source sqliteSource
+	for _, test := range []struct {
+		name, path string
+	}{
+		{"missing column", "file:errors?mode=memory&cache=shared&table=domains"},
+		{"unknown column", "file:errors?mode=memory&cache=shared&table=domains&column=none"},
+		{"missing file", missing + "?table=domains&column=fqdn"},
+	} {
+		if f, err := source.open(context.Background(), test.path); err == nil {
+			f.Close()
+			t.Errorf("%v: opening did not fail", test.name)
+		}
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing database file was created: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bronger/apply_my_lists/applymylists"
+	"golang.org/x/exp/maps"
+)
+
+// statistics holds the metrics of a run of the program.  They are printed in
+// dry-run mode and can be written as JSON for monitoring.
+type statistics struct {
+	DomainsRead       int `json:"domains_read"`
+	TLDs              int `json:"tlds"`
+	BlacklistAdded    int `json:"blacklist_added"`
+	WhitelistRemoved  int `json:"whitelist_removed"`
+	ExplicitWhitelist int `json:"explicit_whitelist"`
+	MinimalCount      int `json:"minimal_count"`
+	// MinimizationRatio is the number of minimal domains divided by the
+	// number of domains left after applying the whitelists.
+	MinimizationRatio float64 `json:"minimization_ratio"`
+	DurationMS        int64   `json:"duration_ms"`
+}
+
+// setMinimal sets the number of minimal domains and the resulting
+// minimisation ratio.  “numberRemaining” is the number of domains before the
+// minimisation.  If it is zero, the ratio is 1, i.e. no reduction.
+func (s *statistics) setMinimal(numberMinimal, numberRemaining int) {
+	s.MinimalCount = numberMinimal
+	s.MinimizationRatio = 1
+	if numberRemaining > 0 {
+		s.MinimizationRatio = float64(numberMinimal) / float64(numberRemaining)
+	}
+}
+
+// reduction returns the percentage by which the minimisation reduced the
+// number of domains, formatted for humans.
+func (s statistics) reduction() string {
+	return fmt.Sprintf("%.1f%%", 100*(1-s.MinimizationRatio))
+}
+
+// print writes the statistics in human-readable form to “w”.
+func (s statistics) print(w io.Writer) {
+	fmt.Fprintf(w, "Domains read:                 %d\n", s.DomainsRead)
+	fmt.Fprintf(w, "Domains added by blacklist:   %d\n", s.BlacklistAdded)
+	fmt.Fprintf(w, "Domains removed by whitelist: %d\n", s.WhitelistRemoved)
+	fmt.Fprintf(w, "Explicit whitelist entries:   %d\n", s.ExplicitWhitelist)
+	fmt.Fprintf(w, "Minimal domains:              %d\n", s.MinimalCount)
+	fmt.Fprintf(w, "Reduction by minimisation:    %s\n", s.reduction())
+}
+
+// writeJSON writes the statistics as a JSON object to the file at “path”.  If
+// “path” is “-”, it writes to “stdout”.  Since the file is written, an error
+// when closing it is returned, too.
+func (s statistics) writeJSON(path string, stdout io.Writer) (err error) {
+	w := stdout
+	if path != "-" {
+		f, createErr := os.Create(path)
+		if createErr != nil {
+			return fmt.Errorf("Could not create statistics file “%v”: %w", path, createErr)
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("Could not close statistics file “%v”: %w", path, closeErr)
+			}
+		}()
+		w = f
+	}
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("Could not write statistics to “%v”: %w", path, err)
+	}
+	return nil
+}
+
+// dominanceThreshold is the share of all domains above which a single TLD of
+// the input file is suspicious, see dominantTLD.
+const dominanceThreshold = 0.8
+
+// dominanceMinDomains is the number of domains below which dominantTLD does not
+// report anything, because small lists are naturally skewed.
+const dominanceMinDomains = 1000
+
+// dominantTLD returns the TLD in “counts” holding more than dominanceThreshold
+// of all domains, and its share.  This often indicates a malformed input file
+// or a compromised source.  If there is no such TLD, or there are fewer than
+// dominanceMinDomains domains, “tld” is empty.
+func dominantTLD(counts map[string]int) (tld string, share float64) {
+	var total, largest int
+	for candidate, count := range counts {
+		total += count
+		if count > largest {
+			tld, largest = candidate, count
+		}
+	}
+	if total < dominanceMinDomains {
+		return "", 0
+	}
+	share = float64(largest) / float64(total)
+	if share <= dominanceThreshold {
+		return "", 0
+	}
+	return tld, share
+}
+
+// printWhitelistLint writes the findings of applymylists.LintWhitelist to “w”,
+// one per line: “redundant”, the entry, and the entry covering it, or
+// “orphan” and the entry, separated by tabs.
+func printWhitelistLint(w io.Writer, redundant []applymylists.RedundantEntry, orphans []string) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range redundant {
+		fmt.Fprintf(bw, "redundant\t%s\t%s\n", entry.Entry, entry.CoveredBy)
+	}
+	for _, entry := range orphans {
+		fmt.Fprintf(bw, "orphan\t%s\n", entry)
+	}
+	return bw.Flush()
+}
+
+// printTLDCounts writes the TLDs in “counts” together with their numbers of
+// domains to “w”, one per line, the TLDs with the most domains first.
+func printTLDCounts(w io.Writer, counts map[string]int) error {
+	tlds := maps.Keys(counts)
+	slices.SortFunc(tlds, func(a, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	bw := bufio.NewWriter(w)
+	for _, tld := range tlds {
+		fmt.Fprintf(bw, "%d\t%s\n", counts[tld], tld)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatisticsSetMinimal(t *testing.T) {
+	for _, test := range []struct {
+		numberMinimal, numberRemaining int
+		ratio                          float64
+		reduction                      string
+	}{
+		{340000, 1200000, 340000.0 / 1200000, "71.7%"},
+		{5, 5, 1, "0.0%"},
+		{0, 0, 1, "0.0%"},
+	} {
+		var stats statistics
+		stats.setMinimal(test.numberMinimal, test.numberRemaining)
+		if stats.MinimalCount != test.numberMinimal || stats.MinimizationRatio != test.ratio {
+			t.Errorf("setMinimal(%d, %d): got %d, %v, want %d, %v", test.numberMinimal, test.numberRemaining,
+				stats.MinimalCount, stats.MinimizationRatio, test.numberMinimal, test.ratio)
+		}
+		if got := stats.reduction(); got != test.reduction {
+			t.Errorf("setMinimal(%d, %d): got reduction %q, want %q", test.numberMinimal, test.numberRemaining,
+				got, test.reduction)
+		}
+	}
+}
+
+// TestRunMinimizationRatio checks that the ratio refers to the number of
+// domains after applying the whitelist.
+func TestRunMinimizationRatio(t *testing.T) {
+	cfg, dir, _ := newTestConfig(t,
+		"0.0.0.0 a.example.com\n0.0.0.0 b.a.example.com\n0.0.0.0 c.a.example.com\n0.0.0.0 tracker.example.org\n",
+		"", "tracker.example.org\n")
+	cfg.statsJSONPath = filepath.Join(dir, "stats.json")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(cfg.statsJSONPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats statistics
+	if err := json.Unmarshal(content, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.MinimalCount != 1 || stats.MinimizationRatio != 1.0/3 {
+		t.Errorf("got %d minimal domains and ratio %v, want 1 and 1/3", stats.MinimalCount, stats.MinimizationRatio)
+	}
+}
+
+func TestDominantTLD(t *testing.T) {
+	for _, test := range []struct {
+		counts map[string]int
+		tld    string
+		share  float64
+	}{
+		{map[string]int{"example.com": 800, "example.org": 200}, "", 0},
+		{map[string]int{"example.com": 950, "example.org": 50}, "example.com", 0.95},
+		{map[string]int{"example.com": 500}, "", 0},
+		{map[string]int{"example.com": 2000}, "example.com", 1},
+		{map[string]int{}, "", 0},
+	} {
+		if tld, share := dominantTLD(test.counts); tld != test.tld || share != test.share {
+			t.Errorf("dominantTLD(%v) = %q, %v, want %q, %v", test.counts, tld, share, test.tld, test.share)
+		}
+	}
+}
+
+// TestRunDominantTLD reads an input file with nearly all domains below one
+// TLD, which fails only with -strict.
+func TestRunDominantTLD(t *testing.T) {
+	input := oneTLDHosts(2000)
+	for i := 0; i < 100; i++ {
+		input += fmt.Sprintf("0.0.0.0 s%d.example.org\n", i)
+	}
+	cfg, _, _ := newTestConfig(t, input, "", "")
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	cfg.strict = true
+	err := run(context.Background(), cfg)
+	var exitErr *exitError
+	if !errors.As(err, &exitErr) || exitErr.code != exitInput {
+		t.Fatalf("got error %v, want exit code %d", err, exitInput)
+	}
+	if got := fmt.Sprint(exitErr.args); got != fmt.Sprint([]any{"paths", cfg.inputPaths, "tld", "example.com",
+		"share", "95.2%"}) {
+		t.Errorf("got arguments %v", got)
+	}
+}